@@ -0,0 +1,274 @@
+// Package config loads InstaFix settings from a YAML file, INSTAFIX_* environment variables
+// and command line flags, in increasing order of precedence.
+//
+// Every setting uses the same name everywhere: cache_path in YAML is
+// INSTAFIX_CACHE_PATH in the environment and -cache-path on the command line.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"instafix/handlers"
+	scraper "instafix/handlers/scraper"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Listen      string `yaml:"listen" usage:"Address to listen on"`
+	PprofListen string `yaml:"pprof_listen" usage:"Address to serve pprof on, empty to disable"`
+	LogLevel    string `yaml:"log_level" usage:"Log level: debug, info, warn or error"`
+
+	RemoteScraper  string        `yaml:"remote_scraper" usage:"Remote scraper address (https://github.com/Wikidepia/InstaFix-remote-scraper)"`
+	ScrapeSources  []string      `yaml:"scrape_sources" usage:"Comma separated list of scrape sources to try in order (remote, timeslice, embedhtml, gql)"`
+	ScrapeTimeout  time.Duration `yaml:"scrape_timeout" usage:"Timeout of a single request to Instagram"`
+	CDNHost        string        `yaml:"cdn_host" usage:"Host media URLs are rewritten to, empty to keep Instagram's"`
+	VideoProxyAddr string        `yaml:"video_proxy_addr" usage:"Video proxy address (https://github.com/Wikidepia/InstaFix-proxy)"`
+
+	HostModes map[string]string `yaml:"host_modes" usage:"Embed mode per host prefix as prefix=mode pairs, e.g. d=direct,g=gallery,v=video,t=text. Replaces the defaults, prefixes left out have no mode"`
+
+	ProxyMedia        bool   `yaml:"proxy_media" usage:"Stream images and videos through InstaFix instead of redirecting to Instagram or the video proxy"`
+	ProxyCacheDir     string `yaml:"proxy_cache_dir" usage:"Directory to cache proxied media in, empty to disable"`
+	ProxyCacheEntries int    `yaml:"proxy_cache_entries" usage:"Maximum number of proxied media files to cache"`
+	ProxyCacheSize    int    `yaml:"proxy_cache_size" usage:"Maximum total size of cached proxied media, in MiB"`
+
+	Cache         string        `yaml:"cache" usage:"Cache backend: bolt, memory or a redis:// URL"`
+	CachePath     string        `yaml:"cache_path" usage:"Path of the bolt cache database"`
+	StaleTTL      time.Duration `yaml:"stale_ttl" usage:"Cached posts are refreshed in the background after this"`
+	ExpireTTL     time.Duration `yaml:"expire_ttl" usage:"Cached posts are removed after this"`
+	EvictInterval time.Duration `yaml:"evict_interval" usage:"How often expired posts are removed from cache"`
+	StoryStaleTTL time.Duration `yaml:"story_stale_ttl" usage:"Cached stories are refreshed in the background after this, they expire with the story"`
+	ProfileTTL    time.Duration `yaml:"profile_ttl" usage:"Cached profiles are scraped again after this"`
+
+	StaticDir        string        `yaml:"static_dir" usage:"Directory to store grid images in"`
+	GridCacheEntries int           `yaml:"grid_cache_entries" usage:"Maximum number of grid images to cache"`
+	GridJPEGQuality  int           `yaml:"grid_jpeg_quality" usage:"JPEG quality of grid images, 1 to 100"`
+	GridTimeout      time.Duration `yaml:"grid_timeout" usage:"Timeout of downloading images for a grid"`
+
+	AdminToken  string `yaml:"admin_token" usage:"Bearer token for /admin, admin is disabled unless this or admin_listen is set"`
+	AdminListen string `yaml:"admin_listen" usage:"Serve /admin on its own address instead, e.g. localhost:3001"`
+
+	PublicMetrics bool `yaml:"public_metrics" usage:"Serve /metrics on listen when admin_listen is not set, behind admin_token if set"`
+}
+
+// Default returns the settings used when nothing is configured
+func Default() *Config {
+	return &Config{
+		Listen:            "0.0.0.0:3000",
+		PprofListen:       "localhost:6060",
+		LogLevel:          "error",
+		ScrapeSources:     slices.Clone(scraper.DefaultSources),
+		ScrapeTimeout:     5 * time.Second,
+		CDNHost:           "scontent.cdninstagram.com",
+		HostModes:         maps.Clone(handlers.HostModes),
+		ProxyCacheEntries: 1024,
+		ProxyCacheSize:    2048,
+		Cache:             "bolt",
+		CachePath:         "cache.db",
+		StaleTTL:          24 * time.Hour,
+		ExpireTTL:         7 * 24 * time.Hour,
+		EvictInterval:     5 * time.Minute,
+		StoryStaleTTL:     30 * time.Minute,
+		ProfileTTL:        6 * time.Hour,
+		StaticDir:         "static",
+		GridCacheEntries:  1024,
+		GridJPEGQuality:   80,
+		GridTimeout:       60 * time.Second,
+	}
+}
+
+// fieldFlag keeps a flag as a string until flags are applied, after the file and environment
+type fieldFlag struct {
+	value  string
+	isBool bool
+}
+
+func (f *fieldFlag) String() string     { return f.value }
+func (f *fieldFlag) Set(s string) error { f.value = s; return nil }
+func (f *fieldFlag) IsBoolFlag() bool   { return f.isBool }
+
+// Load reads the config file given by -config or INSTAFIX_CONFIG,
+// then overrides it with environment variables and flags in args
+func Load(args []string, getenv func(string) string) (*Config, error) {
+	cfg := Default()
+	cv := reflect.ValueOf(cfg).Elem()
+
+	fs := flag.NewFlagSet("instafix", flag.ContinueOnError)
+	configPath := fs.String("config", getenv("INSTAFIX_CONFIG"), "Path of the YAML config file")
+	fields := make(map[string]reflect.Value)
+	for n := 0; n < cv.NumField(); n++ {
+		field := cv.Type().Field(n)
+		name := strings.ReplaceAll(field.Tag.Get("yaml"), "_", "-")
+		fields[name] = cv.Field(n)
+		fs.Var(&fieldFlag{value: formatValue(cv.Field(n)), isBool: field.Type.Kind() == reflect.Bool}, name, field.Tag.Get("usage"))
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *configPath != "" {
+		f, err := os.Open(*configPath)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		dec := yaml.NewDecoder(f)
+		dec.KnownFields(true)
+		// YAML merges maps into the defaults, a configured host_modes replaces them like env and flags do
+		defaultHostModes := cfg.HostModes
+		cfg.HostModes = nil
+		if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%s: %w", *configPath, err)
+		}
+		if cfg.HostModes == nil {
+			cfg.HostModes = defaultHostModes
+		}
+	}
+
+	var errs []error
+	for name, field := range fields {
+		env := "INSTAFIX_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		if v := getenv(env); v != "" {
+			if err := setValue(field, v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", env, err))
+			}
+		}
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if field, ok := fields[f.Name]; ok {
+			if err := setValue(field, f.Value.String()); err != nil {
+				errs = append(errs, fmt.Errorf("-%s: %w", f.Name, err))
+			}
+		}
+	})
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate reports every invalid setting at once
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	isURL := func(s string) bool {
+		return s == "" || strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+	}
+
+	check(c.Listen != "", "listen must not be empty")
+	_, err := c.SlogLevel()
+	check(err == nil, "log_level %q is not one of debug, info, warn or error", c.LogLevel)
+	check(isURL(c.RemoteScraper), "remote_scraper must start with http:// or https://")
+	check(isURL(c.VideoProxyAddr), "video_proxy_addr must start with http:// or https://")
+	for prefix, mode := range c.HostModes {
+		check(prefix != "" && !strings.Contains(prefix, "."), "host_modes prefix %q must be a single host label", prefix)
+		check(slices.Contains(handlers.Modes, mode), "host_modes mode %q is not one of %s", mode, strings.Join(handlers.Modes, ", "))
+	}
+	check(len(c.ScrapeSources) > 0, "scrape_sources must not be empty")
+	check(c.ScrapeTimeout > 0, "scrape_timeout must be positive")
+	check(c.ProxyCacheEntries > 0, "proxy_cache_entries must be positive")
+	check(c.ProxyCacheSize > 0, "proxy_cache_size must be positive")
+	check(c.Cache == "bolt" || c.Cache == "memory" || strings.HasPrefix(c.Cache, "redis://"),
+		"cache %q is not one of bolt, memory or a redis:// URL", c.Cache)
+	check(c.Cache != "bolt" || c.CachePath != "", "cache_path must not be empty")
+	check(c.StaleTTL > 0, "stale_ttl must be positive")
+	check(c.ExpireTTL >= c.StaleTTL, "expire_ttl must not be shorter than stale_ttl")
+	check(c.EvictInterval > 0, "evict_interval must be positive")
+	check(c.StoryStaleTTL > 0, "story_stale_ttl must be positive")
+	check(c.ProfileTTL > 0, "profile_ttl must be positive")
+	check(c.StaticDir != "", "static_dir must not be empty")
+	check(c.GridCacheEntries > 0, "grid_cache_entries must be positive")
+	check(c.GridJPEGQuality >= 1 && c.GridJPEGQuality <= 100, "grid_jpeg_quality must be between 1 and 100")
+	check(c.GridTimeout > 0, "grid_timeout must be positive")
+	return errors.Join(errs...)
+}
+
+// SlogLevel parses LogLevel
+func (c *Config) SlogLevel() (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(c.LogLevel))
+	return level, err
+}
+
+func formatValue(v reflect.Value) string {
+	switch v := v.Interface().(type) {
+	case time.Duration:
+		return v.String()
+	case []string:
+		return strings.Join(v, ",")
+	case map[string]string:
+		pairs := make([]string, 0, len(v))
+		for key, value := range v {
+			pairs = append(pairs, key+"="+value)
+		}
+		slices.Sort(pairs)
+		return strings.Join(pairs, ",")
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+func setValue(v reflect.Value, s string) error {
+	switch v.Interface().(type) {
+	case string:
+		v.SetString(s)
+	case int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(n))
+	case bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case []string:
+		var list []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	case map[string]string:
+		m := make(map[string]string)
+		for _, pair := range strings.Split(s, ",") {
+			if pair = strings.TrimSpace(pair); pair == "" {
+				continue
+			}
+			key, value, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("%q is not a key=value pair", pair)
+			}
+			m[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+		v.Set(reflect.ValueOf(m))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package config
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "instafix.yaml")
+	err := os.WriteFile(path, []byte("listen: file:3000\nlog_level: warn\nstale_ttl: 12h\ngrid_jpeg_quality: 90\nscrape_sources: [embedhtml, gql]\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{
+		"INSTAFIX_CONFIG":            path,
+		"INSTAFIX_LISTEN":            "env:3000",
+		"INSTAFIX_GRID_JPEG_QUALITY": "70",
+	}
+
+	cfg, err := Load([]string{"-listen", "flag:3000", "-proxy-media", "-host-modes", "dd=direct, x=text"}, func(key string) string { return env[key] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Listen != "flag:3000" {
+		t.Errorf("listen: got %q, flag should win", cfg.Listen)
+	}
+	if cfg.GridJPEGQuality != 70 {
+		t.Errorf("grid_jpeg_quality: got %d, env should win over file", cfg.GridJPEGQuality)
+	}
+	if cfg.StaleTTL != 12*time.Hour || cfg.LogLevel != "warn" || strings.Join(cfg.ScrapeSources, ",") != "embedhtml,gql" {
+		t.Errorf("file settings not applied: %+v", cfg)
+	}
+	if !cfg.ProxyMedia {
+		t.Error("proxy_media: bool flag without value not applied")
+	}
+	if len(cfg.HostModes) != 2 || cfg.HostModes["dd"] != "direct" || cfg.HostModes["x"] != "text" {
+		t.Errorf("host_modes: got %v", cfg.HostModes)
+	}
+	if cfg.ExpireTTL != Default().ExpireTTL {
+		t.Errorf("expire_ttl: got %v, want default", cfg.ExpireTTL)
+	}
+}
+
+func TestLoadHostModes(t *testing.T) {
+	tests := []struct {
+		yaml string
+		want map[string]string
+	}{
+		{yaml: "listen: file:3000\n", want: Default().HostModes},
+		{yaml: "host_modes:\n  dd: direct\n", want: map[string]string{"dd": "direct"}},
+		{yaml: "host_modes: {}\n", want: map[string]string{}},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "instafix.yaml")
+		if err := os.WriteFile(path, []byte(tt.yaml), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := Load([]string{"-config", path}, func(string) string { return "" })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !maps.Equal(cfg.HostModes, tt.want) {
+			t.Errorf("%q: got host_modes %v, want %v", tt.yaml, cfg.HostModes, tt.want)
+		}
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	noEnv := func(string) string { return "" }
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"-grid-jpeg-quality", "0", "-remote-scraper", "ftp://x"}, []string{"grid_jpeg_quality", "remote_scraper"}},
+		{[]string{"-stale-ttl", "soon"}, []string{"-stale-ttl"}},
+		{[]string{"-stale-ttl", "8d"}, []string{"-stale-ttl"}},
+		{[]string{"-cache", "sqlite"}, []string{"cache \"sqlite\""}},
+		{[]string{"-log-level", "loud"}, []string{"log_level"}},
+		{[]string{"-host-modes", "d=dark"}, []string{"host_modes mode \"dark\""}},
+		{[]string{"-host-modes", "direct"}, []string{"-host-modes"}},
+	}
+	for _, tt := range tests {
+		_, err := Load(tt.args, noEnv)
+		if err == nil {
+			t.Errorf("%v: expected an error", tt.args)
+			continue
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%v: error %q doesn't mention %q", tt.args, err, want)
+			}
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "instafix.yaml")
+	os.WriteFile(path, []byte("listne: typo:3000\n"), 0644)
+	if _, err := Load([]string{"-config", path}, noEnv); err == nil {
+		t.Error("expected an error for unknown config key")
+	}
+}
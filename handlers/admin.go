@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"errors"
+	scraper "instafix/handlers/scraper"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type adminPost struct {
+	Data         *scraper.InstaData `json:"data"`
+	StaleAt      time.Time          `json:"stale_at"`
+	ExpiresAt    time.Time          `json:"expires_at"`
+	CDNExpiresAt time.Time          `json:"cdn_expires_at"`
+}
+
+type adminStats struct {
+	Cache map[string]int `json:"cache"`
+	Grid  struct {
+		Entries  int `json:"entries"`
+		Capacity int `json:"capacity"`
+	} `json:"grid"`
+}
+
+// AdminAuth rejects requests without "Authorization: Bearer <token>",
+// an empty token allows everything (admin router on its own listen address)
+func AdminAuth(token string) func(http.Handler) http.Handler {
+	want := []byte("Bearer " + token)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeJSON(w, http.StatusUnauthorized, apiError{Error: "unauthorized"})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func writeAdminPost(w http.ResponseWriter, item *scraper.InstaData) {
+	writeJSON(w, http.StatusOK, adminPost{
+		Data:         item,
+		StaleAt:      item.StaleAt,
+		ExpiresAt:    item.ExpiresAt,
+		CDNExpiresAt: item.CDNExpiresAt,
+	})
+}
+
+// AdminPost returns the cached data of a post without scraping it
+func AdminPost(w http.ResponseWriter, r *http.Request) {
+	item, err := scraper.Lookup(chi.URLParam(r, "postID"))
+	switch {
+	case errors.Is(err, scraper.ErrCacheMiss):
+		writeJSON(w, http.StatusNotFound, apiError{Error: "post is not cached"})
+	case err != nil:
+		writeJSON(w, apiErrorStatus(err), apiError{Error: err.Error()})
+	default:
+		writeAdminPost(w, item)
+	}
+}
+
+// AdminRefresh scrapes a post again and returns the new data
+func AdminRefresh(w http.ResponseWriter, r *http.Request) {
+	postID := chi.URLParam(r, "postID")
+	item, err := scraper.Refresh(r.Context(), postID)
+	if err != nil {
+		writeJSON(w, apiErrorStatus(err), apiError{Error: err.Error()})
+		return
+	}
+	// Grid is made from the old media
+	removeGrid(postID)
+	writeAdminPost(w, item)
+}
+
+// AdminPurge removes a post and its grid from cache
+func AdminPurge(w http.ResponseWriter, r *http.Request) {
+	postID := chi.URLParam(r, "postID")
+	if err := scraper.Purge(postID); err != nil {
+		writeJSON(w, apiErrorStatus(err), apiError{Error: err.Error()})
+		return
+	}
+	if err := removeGrid(postID); err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AdminStats reports cache sizes
+func AdminStats(w http.ResponseWriter, r *http.Request) {
+	var stats adminStats
+	var err error
+	stats.Cache, err = scraper.DB.Stats()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return
+	}
+	if scraper.LRU != nil {
+		stats.Grid.Entries = scraper.LRU.Len()
+		stats.Grid.Capacity = scraper.LRUCapacity
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// removeGrid removes the grid of postID and its styled variants
+func removeGrid(postID string) error {
+	gridFnames := []string{gridPath(postID)}
+	dir, err := os.ReadDir(scraper.StaticDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	variantPrefix := strings.TrimSuffix(filepath.Base(gridFnames[0]), ".jpeg") + gridVariantSep
+	for _, d := range dir {
+		if strings.HasPrefix(d.Name(), variantPrefix) {
+			gridFnames = append(gridFnames, filepath.Join(scraper.StaticDir, d.Name()))
+		}
+	}
+	for _, gridFname := range gridFnames {
+		// Removing from LRU deletes the file too, unless it isn't tracked
+		if scraper.LRU != nil {
+			scraper.LRU.Remove(gridFname)
+		}
+		if err := os.Remove(gridFname); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
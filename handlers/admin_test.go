@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"errors"
+	scraper "instafix/handlers/scraper"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func newAdminRouter(t *testing.T, token string) http.Handler {
+	t.Helper()
+	oldDB := scraper.DB
+	scraper.DB = scraper.NewMemoryCache()
+
+	// Grids are stored relative to the working directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	os.Mkdir("static", 0755)
+	t.Cleanup(func() {
+		scraper.DB.Close()
+		scraper.DB = oldDB
+		os.Chdir(wd)
+	})
+
+	r := chi.NewRouter()
+	r.Use(AdminAuth(token))
+	r.Get("/stats", AdminStats)
+	r.Get("/post/{postID}", AdminPost)
+	r.Delete("/post/{postID}", AdminPurge)
+	return r
+}
+
+func TestAdminAuth(t *testing.T) {
+	r := newAdminRouter(t, "secret")
+	for auth, want := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"secret":        http.StatusUnauthorized,
+		"Bearer secret": http.StatusOK,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/stats", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("Authorization %q: got status %d, want %d", auth, w.Code, want)
+		}
+	}
+}
+
+func TestAdminPurge(t *testing.T) {
+	r := newAdminRouter(t, "")
+	scraper.DB.Set("CPurge00001", []byte("cached"), time.Hour)
+	for _, name := range []string{"CPurge00001.jpeg", "CPurge00001+n+g8.jpeg", "CPurge000012.jpeg"} {
+		if err := os.WriteFile("static/"+name, []byte("grid"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/post/CPurge00001", nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, want 204: %s", w.Code, w.Body)
+	}
+	if _, err := scraper.DB.Get("CPurge00001"); !errors.Is(err, scraper.ErrCacheMiss) {
+		t.Errorf("post still cached, got %v", err)
+	}
+	for _, name := range []string{"CPurge00001.jpeg", "CPurge00001+n+g8.jpeg"} {
+		if _, err := os.Stat("static/" + name); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("grid %s not removed, got %v", name, err)
+		}
+	}
+	if _, err := os.Stat("static/CPurge000012.jpeg"); err != nil {
+		t.Errorf("grid of another post removed, got %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/post/CPurge00001", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("lookup after purge: got status %d, want 404", w.Code)
+	}
+}
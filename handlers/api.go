@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	scraper "instafix/handlers/scraper"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/go-chi/chi/v5"
+)
+
+type apiMedia struct {
+	Type         string `json:"type"`
+	URL          string `json:"url"`
+	ProxiedURL   string `json:"proxied_url"`
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+	Width        int    `json:"width,omitempty"`
+	Height       int    `json:"height,omitempty"`
+}
+
+type apiPost struct {
+	PostID     string     `json:"post_id"`
+	Username   string     `json:"username"`
+	FullName   string     `json:"full_name,omitempty"`
+	IsVerified bool       `json:"is_verified"`
+	Caption    string     `json:"caption"`
+	Location   string     `json:"location,omitempty"`
+	Timestamp  int64      `json:"timestamp,omitempty"`
+	Likes      int64      `json:"likes"`
+	Comments   int64      `json:"comments"`
+	Views      int64      `json:"views,omitempty"`
+	Medias     []apiMedia `json:"medias"`
+	CoverURL   string     `json:"cover_url,omitempty"` // Highlights only
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// apiErrorStatus maps scraper errors to HTTP status codes
+func apiErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, scraper.ErrInvalidPostID), errors.Is(err, scraper.ErrInvalidUsername):
+		return http.StatusBadRequest
+	case errors.Is(err, scraper.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, scraper.ErrPrivate):
+		return http.StatusForbidden
+	default:
+		// Anything else means Instagram didn't give us the post
+		return http.StatusBadGateway
+	}
+}
+
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// APIPost returns the scraped post as JSON
+func APIPost(w http.ResponseWriter, r *http.Request) {
+	postID := chi.URLParam(r, "postID")
+	item, err := scraper.GetData(r.Context(), postID)
+	if errors.Is(err, context.Canceled) {
+		return
+	} else if err != nil {
+		writeJSON(w, apiErrorStatus(err), apiError{Error: err.Error()})
+		return
+	}
+
+	// Cache as long as the cached data is fresh, it changes on every scrape
+	etag := `"` + strconv.FormatUint(xxhash.Sum64String(item.PostID+strconv.FormatInt(item.ExpiresAt.UnixNano(), 10)), 36) + `"`
+	maxAge := max(0, int(time.Until(item.FreshUntil()).Seconds()))
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(maxAge))
+	if match := r.Header.Get("If-None-Match"); match != "" && strings.Contains(match, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	base := baseURL(r)
+	post := apiPost{
+		PostID:     item.PostID,
+		Username:   item.Username,
+		FullName:   item.FullName,
+		IsVerified: item.IsVerified,
+		Caption:    item.Caption,
+		Location:   item.Location,
+		Timestamp:  item.Timestamp,
+		Likes:      item.Likes,
+		Comments:   item.Comments,
+		Views:      item.Views,
+		Medias:     make([]apiMedia, 0, len(item.Medias)),
+	}
+	if scraper.IsHighlightID(item.PostID) {
+		post.CoverURL = base + "/covers/" + item.PostID
+	}
+	for n, media := range item.Medias {
+		mediaNum := strconv.Itoa(n + 1)
+		proxied := base + "/images/" + item.PostID + "/" + mediaNum
+		if !media.IsImage() {
+			proxied = base + "/videos/" + item.PostID + "/" + mediaNum
+		}
+		post.Medias = append(post.Medias, apiMedia{
+			Type:         media.TypeName,
+			URL:          media.URL,
+			ProxiedURL:   proxied,
+			ThumbnailURL: media.ThumbnailURL,
+			Width:        media.Width,
+			Height:       media.Height,
+		})
+	}
+	writeJSON(w, http.StatusOK, post)
+}
@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	scraper "instafix/handlers/scraper"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/go-chi/chi/v5"
+)
+
+func newAPIRouter() http.Handler {
+	r := chi.NewRouter()
+	r.Get("/api/v1/post/{postID}", APIPost)
+	return r
+}
+
+func apiGet(r http.Handler, postID string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "http://ddinstagram.com/api/v1/post/"+postID, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestAPIPostStatus(t *testing.T) {
+	f := useFakeSource(t)
+	f.posts["CApiPost001"] = &scraper.InstaData{
+		Username: "natgeo",
+		Medias:   []scraper.Media{{TypeName: "GraphImage", URL: "https://scontent.cdninstagram.com/a.jpg", Width: 1080, Height: 1080}},
+	}
+	f.errs["CApiNotFnd1"] = scraper.ErrNotFound
+	f.errs["CApiPrivat1"] = fmt.Errorf("%w: login page", scraper.ErrPrivate)
+	f.errs["CApiRateLm1"] = scraper.ErrRateLimited
+	f.errs["CApiChange1"] = scraper.ErrUpstreamChanged
+	f.errs["CApiNetwrk1"] = scraper.ErrNetwork
+
+	tests := []struct {
+		postID string
+		want   int
+	}{
+		{postID: "CApiPost001", want: http.StatusOK},
+		{postID: "XInvalid", want: http.StatusBadRequest},
+		{postID: "CApiNotFnd1", want: http.StatusNotFound},
+		{postID: "CApiPrivat1", want: http.StatusForbidden},
+		{postID: "CApiRateLm1", want: http.StatusBadGateway},
+		{postID: "CApiChange1", want: http.StatusBadGateway},
+		{postID: "CApiNetwrk1", want: http.StatusBadGateway},
+	}
+	r := newAPIRouter()
+	for _, tt := range tests {
+		// Twice, the second failure comes from the negative cache
+		for range 2 {
+			w := apiGet(r, tt.postID, nil)
+			if w.Code != tt.want {
+				t.Errorf("%s: got status %d, want %d: %s", tt.postID, w.Code, tt.want, w.Body)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("%s: got Content-Type %q", tt.postID, ct)
+			}
+		}
+	}
+}
+
+func TestAPIPostMedia(t *testing.T) {
+	f := useFakeSource(t)
+	f.posts["CApiMedia01"] = &scraper.InstaData{
+		Username: "natgeo",
+		Medias: []scraper.Media{
+			{TypeName: "GraphImage", URL: "https://scontent.cdninstagram.com/a.jpg", Width: 1080, Height: 1080},
+			{TypeName: "GraphVideo", URL: "https://scontent.cdninstagram.com/b.mp4", ThumbnailURL: "https://scontent.cdninstagram.com/b.jpg", Width: 1080, Height: 1920},
+			{TypeName: "StoryVideo", URL: "https://scontent.cdninstagram.com/c.jpg", Width: 1080, Height: 1920},
+		},
+	}
+
+	w := apiGet(newAPIRouter(), "CApiMedia01", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	var got apiPost
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"http://ddinstagram.com/images/CApiMedia01/1",
+		"http://ddinstagram.com/videos/CApiMedia01/2",
+		"http://ddinstagram.com/images/CApiMedia01/3",
+	}
+	if len(got.Medias) != len(want) {
+		t.Fatalf("got %d medias, want %d", len(got.Medias), len(want))
+	}
+	for n, m := range got.Medias {
+		if m.ProxiedURL != want[n] {
+			t.Errorf("media %d: got %q, want %q", n+1, m.ProxiedURL, want[n])
+		}
+	}
+}
+
+func TestAPIPostCaching(t *testing.T) {
+	f := useFakeSource(t)
+	f.posts["CApiCache01"] = &scraper.InstaData{
+		Username: "natgeo",
+		Medias:   []scraper.Media{{TypeName: "GraphImage", URL: "https://scontent.cdninstagram.com/a.jpg", Width: 1080, Height: 1080}},
+	}
+	r := newAPIRouter()
+
+	w := apiGet(r, "CApiCache01", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	item, err := scraper.Lookup("CApiCache01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	etag := `"` + strconv.FormatUint(xxhash.Sum64String(item.PostID+strconv.FormatInt(item.ExpiresAt.UnixNano(), 10)), 36) + `"`
+	if got := w.Header().Get("ETag"); got != etag {
+		t.Errorf("got ETag %s, want %s", got, etag)
+	}
+
+	// Cached for as long as the data is fresh
+	cacheControl := w.Header().Get("Cache-Control")
+	maxAge, err := strconv.Atoi(strings.TrimPrefix(cacheControl, "public, max-age="))
+	if err != nil {
+		t.Fatalf("got Cache-Control %q: %v", cacheControl, err)
+	}
+	if want := int(scraper.StaleTTL.Seconds()); maxAge > want || maxAge < want-60 {
+		t.Errorf("got max-age %d, want about %d", maxAge, want)
+	}
+
+	tests := []struct {
+		ifNoneMatch string
+		want        int
+	}{
+		{ifNoneMatch: etag, want: http.StatusNotModified},
+		{ifNoneMatch: `"other", ` + etag, want: http.StatusNotModified},
+		{ifNoneMatch: `"other"`, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := apiGet(r, "CApiCache01", http.Header{"If-None-Match": {tt.ifNoneMatch}})
+		if w.Code != tt.want {
+			t.Errorf("If-None-Match %s: got status %d, want %d", tt.ifNoneMatch, w.Code, tt.want)
+		}
+		if w.Code == http.StatusNotModified && w.Body.Len() > 0 {
+			t.Errorf("If-None-Match %s: got body %q, want none", tt.ifNoneMatch, w.Body)
+		}
+	}
+	if hits := f.Hits("CApiCache01"); hits != 1 {
+		t.Errorf("scraped %d times, want 1", hits)
+	}
+
+	// A new scrape is a new version
+	if _, err := scraper.Refresh(context.Background(), "CApiCache01"); err != nil {
+		t.Fatal(err)
+	}
+	if w := apiGet(r, "CApiCache01", http.Header{"If-None-Match": {etag}}); w.Code != http.StatusOK {
+		t.Errorf("after refresh: got status %d, want 200", w.Code)
+	}
+}
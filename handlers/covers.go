@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	scraper "instafix/handlers/scraper"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Covers redirects to the cover image of a highlight
+func Covers(w http.ResponseWriter, r *http.Request) {
+	postID := chi.URLParam(r, "postID")
+	item, err := scraper.GetData(r.Context(), postID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	coverURL := item.Cover()
+	if len(coverURL) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	if ProxyMedia {
+		proxyMediaURL(w, r, coverURL)
+		return
+	}
+	http.Redirect(w, r, coverURL, http.StatusFound)
+}
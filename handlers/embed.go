@@ -1,121 +1,252 @@
 package handlers
 
 import (
+	"context"
 	"errors"
 	scraper "instafix/handlers/scraper"
+	"instafix/handlers/threads"
 	"instafix/utils"
 	"instafix/views"
 	"instafix/views/model"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
-	"path"
 	"strconv"
 	"strings"
+	"time"
+)
+
+// errorDescriptions are shown instead of the caption when scraping failed
+var errorDescriptions = []struct {
+	kind error
+	desc string
+}{
+	{scraper.ErrNotFound, "Post not found, it may have been deleted."},
+	{scraper.ErrPrivate, "This post is private or requires login."},
+	{scraper.ErrRateLimited, "InstaFix is rate limited by Instagram, try again later."},
+	{scraper.ErrUpstreamChanged, "Instagram changed something, InstaFix can't read this post right now."},
+	{scraper.ErrNetwork, "Failed to reach Instagram, try again later."},
+}
+
+func errorDescription(err error) string {
+	for _, e := range errorDescriptions {
+		if errors.Is(err, e.kind) {
+			return e.desc
+		}
+	}
+	return ""
+}
 
-	"github.com/go-chi/chi/v5"
+// Embed modes, picked by host prefix, query parameter or X-Embed-Type header
+const (
+	ModeDirect  = "direct"  // Redirect to the media itself
+	ModeGallery = "gallery" // Media without caption
+	ModeVideo   = "video"   // Only the video of the post, even when it has images
+	ModeText    = "text"    // Caption without media
 )
 
-func mediaidToCode(mediaID int) string {
-	alphabet := "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
-	var shortCode string
+var Modes = []string{ModeDirect, ModeGallery, ModeVideo, ModeText}
+
+// HostModes maps the first label of the Host header to an embed mode, e.g. d.ddinstagram.com
+var HostModes = map[string]string{
+	"d": ModeDirect,
+	"g": ModeGallery,
+	"v": ModeVideo,
+	"t": ModeText,
+}
+
+type embedModes struct {
+	direct, gallery, video, text bool
+}
+
+func (m *embedModes) set(mode string) {
+	switch mode {
+	case ModeDirect:
+		m.direct = true
+	case ModeGallery:
+		m.gallery = true
+	case ModeVideo:
+		m.video = true
+	case ModeText:
+		m.text = true
+	}
+}
+
+// getEmbedModes reads the embed modes of r from its host, query and headers
+func getEmbedModes(r *http.Request) embedModes {
+	var modes embedModes
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if prefix, _, ok := strings.Cut(host, "."); ok {
+		modes.set(HostModes[strings.ToLower(prefix)])
+	}
 
-	for mediaID > 0 {
-		remainder := mediaID % 64
-		mediaID /= 64
-		shortCode = string(alphabet[remainder]) + shortCode
+	urlQuery := r.URL.Query()
+	for _, mode := range Modes {
+		if ok, _ := strconv.ParseBool(urlQuery.Get(mode)); ok {
+			modes.set(mode)
+		}
 	}
 
-	return shortCode
+	// Get modes from header too, nginx query params is pain in the ass
+	modes.set(r.Header.Get("X-Embed-Type"))
+	return modes
 }
 
-func getSharePostID(postID string) (string, error) {
-	req, err := http.NewRequest("HEAD", "https://www.instagram.com/share/reel/"+postID+"/", nil)
-	if err != nil {
+var errNoPost = errors.New("link doesn't point at a post")
+
+// resolveLink returns the postID link points at
+func resolveLink(ctx context.Context, link utils.Link) (string, error) {
+	switch link.Kind {
+	case utils.LinkStory:
+		return scraper.StoryID(link.Username, link.ID), nil
+	case utils.LinkHighlight:
+		return scraper.HighlightID(link.ID), nil
+	case utils.LinkThreads:
+		return threads.PostID(link.ID), nil
+	case utils.LinkShare:
+		postID, err := scraper.ResolveShare(ctx, link)
+		if err != nil && len(scraper.RemoteScraperAddr) > 0 {
+			// Let the remote scraper try the share ID
+			return link.ID, nil
+		}
 		return postID, err
+	case utils.LinkAudio, utils.LinkProfile:
+		return "", errNoPost
 	}
-	resp, err := http.DefaultTransport.RoundTrip(req)
-	if err != nil {
-		return postID, err
+	return link.ID, nil
+}
+
+// postDescription returns the caption, cut to what embeds show, followed by the stats
+func postDescription(item *scraper.InstaData) string {
+	description := item.Caption
+	if len(description) > 255 {
+		description = utils.Substr(description, 0, 250) + "..."
 	}
-	defer resp.Body.Close()
-	redirURL, err := url.Parse(resp.Header.Get("Location"))
-	if err != nil {
-		return postID, err
+	return description + postStats(item)
+}
+
+// postStats returns the likes, comments, views and location line appended to captions
+func postStats(item *scraper.InstaData) string {
+	var sb strings.Builder
+	if item.Likes > 0 {
+		sb.WriteString("❤️ ")
+		sb.WriteString(utils.FormatCount(item.Likes))
+		sb.WriteString(" ")
+	}
+	if item.Comments > 0 {
+		sb.WriteString("💬 ")
+		sb.WriteString(utils.FormatCount(item.Comments))
+		sb.WriteString(" ")
+	}
+	if item.Views > 0 {
+		sb.WriteString("👁️ ")
+		sb.WriteString(utils.FormatCount(item.Views))
+		sb.WriteString(" ")
+	}
+	stats := strings.TrimSpace(sb.String())
+	if len(item.Location) > 0 {
+		if len(stats) > 0 {
+			stats += "\n"
+		}
+		stats += "📍 " + item.Location
+	}
+	if len(stats) == 0 {
+		return ""
 	}
-	postID = path.Base(redirURL.Path)
-	if postID == "login" {
-		return postID, errors.New("not logged in")
+	return "\n\n" + stats
+}
+
+// Most highlight items listed in the description, Discord cuts it off after a few lines anyway
+const maxHighlightItems = 10
+
+// highlightItems returns the direct links of every highlight item appended to the title
+func highlightItems(base string, item *scraper.InstaData) string {
+	var sb strings.Builder
+	for n, media := range item.Medias {
+		if n == maxHighlightItems {
+			sb.WriteString("\n… and ")
+			sb.WriteString(strconv.Itoa(len(item.Medias) - n))
+			sb.WriteString(" more")
+			break
+		}
+		sb.WriteString("\n")
+		sb.WriteString(strconv.Itoa(n + 1))
+		if media.IsImage() {
+			sb.WriteString(". 🖼️ ")
+			sb.WriteString(base + "/images/")
+		} else {
+			sb.WriteString(". 🎞️ ")
+			sb.WriteString(base + "/videos/")
+		}
+		sb.WriteString(item.PostID)
+		sb.WriteString("/")
+		sb.WriteString(strconv.Itoa(n + 1))
+	}
+	return "\n" + sb.String()
+}
+
+// oembedURL returns the oEmbed endpoint of mediaNum of postID, 0 for the whole post
+func oembedURL(r *http.Request, postID string, mediaNum int) string {
+	postURL := scraper.PostURL(postID)
+	if mediaNum > 0 {
+		postURL += "?img_index=" + strconv.Itoa(mediaNum)
 	}
-	return postID, nil
+	return baseURL(r) + "/oembed?url=" + url.QueryEscape(postURL)
 }
 
 func Embed(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	viewsData := &model.ViewsData{}
 
-	var err error
-	postID := chi.URLParam(r, "postID")
-	mediaNumParams := chi.URLParam(r, "mediaNum")
-	urlQuery := r.URL.Query()
-	if urlQuery == nil {
+	link, err := utils.MatchLink(r.URL.Path, r.URL.Query())
+	if errors.Is(err, utils.ErrNotInstagramLink) {
+		// Reserved names and files like /robots.txt
+		http.NotFound(w, r)
 		return
-	}
-	if mediaNumParams == "" {
-		imgIndex := urlQuery.Get("img_index")
-		if imgIndex != "" {
-			mediaNumParams = imgIndex
-		} else {
-			mediaNumParams = "0"
-		}
-	}
-	mediaNum, err := strconv.Atoi(mediaNumParams)
-	if err != nil {
+	} else if err != nil {
 		viewsData.Description = "Invalid img_index parameter"
 		views.Embed(viewsData, w)
 		return
 	}
+	mediaNum := link.MediaNum
+	modes := getEmbedModes(r)
 
-	isDirect, _ := strconv.ParseBool(urlQuery.Get("direct"))
-	isGallery, _ := strconv.ParseBool(urlQuery.Get("gallery"))
+	// If User-Agent is not bot, redirect to Instagram
+	viewsData.Title = "InstaFix"
+	viewsData.URL = link.URL()
+	if !utils.IsBot(r.Header.Get("User-Agent")) || link.Kind == utils.LinkAudio {
+		http.Redirect(w, r, viewsData.URL, http.StatusFound)
+		return
+	}
 
-	// Get direct/gallery from header too, nginx query params is pain in the ass
-	embedType := r.Header.Get("X-Embed-Type")
-	if embedType == "direct" {
-		isDirect = true
-	} else if embedType == "gallery" {
-		isGallery = true
+	if link.Kind == utils.LinkProfile {
+		embedProfile(w, r, viewsData, link.Username, modes)
+		return
 	}
 
-	// Stories use mediaID (int) instead of postID
-	if strings.Contains(r.URL.Path, "/stories/") {
-		mediaID, err := strconv.Atoi(postID)
-		if err != nil {
-			viewsData.Description = "Invalid postID"
-			views.Embed(viewsData, w)
-			return
-		}
-		postID = mediaidToCode(mediaID)
-	} else if strings.Contains(r.URL.Path, "/share/") {
-		postID, err = getSharePostID(postID)
-		if err != nil && len(scraper.RemoteScraperAddr) == 0 {
-			slog.Error("Failed to get new postID from share URL", "postID", postID, "err", err)
-			viewsData.Description = "Failed to get new postID from share URL"
+	postID, err := resolveLink(r.Context(), link)
+	if err != nil {
+		slog.Error("Failed to get postID from link", "link", link.Path, "err", err)
+		viewsData.Description = "Failed to get postID from link"
+		views.Embed(viewsData, w)
+		return
+	}
+
+	item, err := scraper.GetData(r.Context(), postID)
+	if err != nil {
+		if desc := errorDescription(err); len(desc) > 0 {
+			viewsData.Description = desc
 			views.Embed(viewsData, w)
 			return
 		}
-	}
-
-	// If User-Agent is not bot, redirect to Instagram
-	viewsData.Title = "InstaFix"
-	viewsData.URL = "https://instagram.com" + strings.Replace(r.URL.RequestURI(), "/"+mediaNumParams, "", 1)
-	if !utils.IsBot(r.Header.Get("User-Agent")) {
 		http.Redirect(w, r, viewsData.URL, http.StatusFound)
 		return
 	}
-
-	item, err := scraper.GetData(postID)
-	if err != nil || len(item.Medias) == 0 {
+	if len(item.Medias) == 0 {
 		http.Redirect(w, r, viewsData.URL, http.StatusFound)
 		return
 	}
@@ -134,18 +265,64 @@ func Embed(w http.ResponseWriter, r *http.Request) {
 	sb.Grow(32) // 32 bytes should be enough for most cases
 
 	viewsData.Title = "@" + item.Username
+	if len(item.FullName) > 0 {
+		viewsData.Title = item.FullName + " (@" + item.Username + ")"
+	}
+	if item.IsVerified {
+		viewsData.Title += " ☑️"
+	}
 	// Gallery do not have any caption
-	if !isGallery {
-		viewsData.Description = item.Caption
-		if len(viewsData.Description) > 255 {
-			viewsData.Description = utils.Substr(viewsData.Description, 0, 250) + "..."
+	if !modes.gallery {
+		viewsData.Description = postDescription(item)
+	}
+	if item.Timestamp > 0 {
+		viewsData.PublishedTime = time.Unix(item.Timestamp, 0).UTC().Format(time.RFC3339)
+	}
+
+	// oEmbed discovery is on every embed, text and highlight ones included
+	viewsData.OEmbedURL = oembedURL(r, postID, mediaNum)
+
+	// Text mode has no media at all
+	if modes.text {
+		viewsData.Card = "summary"
+		views.Embed(viewsData, w)
+		return
+	}
+
+	// Highlights show their cover and link every item, gallery mode shows the grid instead
+	if scraper.IsHighlightID(postID) && mediaNum == 0 && !modes.gallery && !modes.video {
+		viewsData.Card = "summary_large_image"
+		viewsData.ImageURL = "/covers/" + postID
+		viewsData.Description = strings.TrimSpace(viewsData.Description + highlightItems(baseURL(r), item))
+		if modes.direct {
+			http.Redirect(w, r, viewsData.ImageURL, http.StatusFound)
+			return
+		}
+		views.Embed(viewsData, w)
+		return
+	}
+
+	// Video mode embeds the first video instead of the grid, so does a carousel the grid can't draw two slides of
+	if mediaNum == 0 && (modes.video || len(item.Medias) > 1 && len(gridTiles(item)) < 2) {
+		for n, m := range item.Medias {
+			if !m.IsImage() {
+				mediaNum = n + 1
+				break
+			}
 		}
 	}
 
-	typename := item.Medias[max(1, mediaNum)-1].TypeName
-	isImage := strings.Contains(typename, "Image") || strings.Contains(typename, "StoryVideo")
+	media := item.Medias[max(1, mediaNum)-1]
+	viewsData.Width, viewsData.Height = media.Width, media.Height
+	if viewsData.Width == 0 || viewsData.Height == 0 {
+		// Unknown dimensions, at least keep the player square
+		viewsData.Width, viewsData.Height = 400, 400
+	}
+
+	isImage := media.IsImage()
 	switch {
-	case mediaNum == 0 && isImage && len(item.Medias) > 1:
+	case mediaNum == 0 && len(item.Medias) > 1:
+		// Every slide is in the grid, videos as their poster
 		viewsData.Card = "summary_large_image"
 		sb.WriteString("/grid/")
 		sb.WriteString(postID)
@@ -164,14 +341,17 @@ func Embed(w http.ResponseWriter, r *http.Request) {
 		sb.WriteString("/")
 		sb.WriteString(strconv.Itoa(max(1, mediaNum)))
 		viewsData.VideoURL = sb.String()
-
-		scheme := "http"
-		if r.TLS != nil {
-			scheme = "https"
+		if len(media.ThumbnailURL) > 0 {
+			viewsData.ImageURL = "/thumbnails/" + postID + "/" + strconv.Itoa(max(1, mediaNum))
 		}
-		viewsData.OEmbedURL = scheme + "://" + r.Host + "/oembed?text=" + url.QueryEscape(viewsData.Description) + "&url=" + viewsData.URL
 	}
-	if isDirect {
+
+	// The slide may have changed to a video, its caption is passed for Discord to show it above
+	viewsData.OEmbedURL = oembedURL(r, postID, mediaNum)
+	if len(viewsData.VideoURL) > 0 && len(viewsData.Description) > 0 {
+		viewsData.OEmbedURL += "&caption=1"
+	}
+	if modes.direct {
 		http.Redirect(w, r, sb.String(), http.StatusFound)
 		return
 	}
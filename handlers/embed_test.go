@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	scraper "instafix/handlers/scraper"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGetEmbedModes(t *testing.T) {
+	tests := []struct {
+		host, target, header string
+		want                 embedModes
+	}{
+		{host: "ddinstagram.com", target: "/p/C1", want: embedModes{}},
+		{host: "d.ddinstagram.com", target: "/p/C1", want: embedModes{direct: true}},
+		{host: "G.ddinstagram.com:3000", target: "/p/C1", want: embedModes{gallery: true}},
+		{host: "v.localhost:3000", target: "/p/C1", want: embedModes{video: true}},
+		{host: "t.ddinstagram.com", target: "/p/C1", want: embedModes{text: true}},
+		{host: "localhost:3000", target: "/p/C1", want: embedModes{}},
+		{host: "127.0.0.1:3000", target: "/p/C1", want: embedModes{}},
+		{host: "ddinstagram.com", target: "/p/C1?direct=true", want: embedModes{direct: true}},
+		{host: "g.ddinstagram.com", target: "/p/C1?direct=1", want: embedModes{direct: true, gallery: true}},
+		{host: "ddinstagram.com", target: "/p/C1", header: "gallery", want: embedModes{gallery: true}},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.target, nil)
+		r.Host = tt.host
+		if tt.header != "" {
+			r.Header.Set("X-Embed-Type", tt.header)
+		}
+		if got := getEmbedModes(r); got != tt.want {
+			t.Errorf("%s%s (%s): got %+v, want %+v", tt.host, tt.target, tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestHighlightItems(t *testing.T) {
+	item := &scraper.InstaData{PostID: "highlight:1"}
+	for n := 0; n < maxHighlightItems+2; n++ {
+		item.Medias = append(item.Medias, scraper.Media{TypeName: "GraphImage"})
+	}
+	item.Medias[1].TypeName = "GraphVideo"
+
+	got := strings.Split(strings.TrimSpace(highlightItems("https://ddinstagram.com", item)), "\n")
+	if len(got) != maxHighlightItems+1 {
+		t.Fatalf("got %d lines, want %d", len(got), maxHighlightItems+1)
+	}
+	if want := "1. 🖼️ https://ddinstagram.com/images/highlight:1/1"; got[0] != want {
+		t.Errorf("got %q, want %q", got[0], want)
+	}
+	if want := "2. 🎞️ https://ddinstagram.com/videos/highlight:1/2"; got[1] != want {
+		t.Errorf("got %q, want %q", got[1], want)
+	}
+	if want := "… and 2 more"; got[maxHighlightItems] != want {
+		t.Errorf("got %q, want %q", got[maxHighlightItems], want)
+	}
+}
+
+func TestEmbedCarousel(t *testing.T) {
+	f := useFakeSource(t)
+	f.posts["CEmbedCar01"] = &scraper.InstaData{
+		Username: "natgeo",
+		Medias: []scraper.Media{
+			{TypeName: "GraphImage", URL: "https://scontent.cdninstagram.com/a.jpg", Width: 1080, Height: 1080},
+			{TypeName: "GraphVideo", URL: "https://scontent.cdninstagram.com/b.mp4", ThumbnailURL: "https://scontent.cdninstagram.com/b.jpg", Width: 1080, Height: 1080},
+		},
+	}
+	// Videos without a poster can't be drawn in the grid
+	f.posts["CEmbedCar02"] = &scraper.InstaData{
+		Username: "natgeo",
+		Medias: []scraper.Media{
+			{TypeName: "GraphVideo", URL: "https://scontent.cdninstagram.com/c.mp4", Width: 1080, Height: 1080},
+			{TypeName: "GraphVideo", URL: "https://scontent.cdninstagram.com/d.mp4", Width: 1080, Height: 1080},
+		},
+	}
+	f.posts["CEmbedCar03"] = &scraper.InstaData{
+		Username: "natgeo",
+		Medias: []scraper.Media{
+			{TypeName: "GraphImage", URL: "https://scontent.cdninstagram.com/e.jpg", Width: 1080, Height: 1080},
+			{TypeName: "GraphVideo", URL: "https://scontent.cdninstagram.com/f.mp4", Width: 1080, Height: 1080},
+		},
+	}
+
+	tests := []struct {
+		postID, want string
+	}{
+		{postID: "CEmbedCar01", want: "/grid/CEmbedCar01"},
+		{postID: "CEmbedCar02", want: "/videos/CEmbedCar02/1"},
+		{postID: "CEmbedCar03", want: "/videos/CEmbedCar03/2"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "http://ddinstagram.com/p/"+tt.postID+"?direct=true", nil)
+		r.Header.Set("User-Agent", "Mozilla/5.0 (compatible; Discordbot/2.0; +https://discordapp.com)")
+		w := httptest.NewRecorder()
+		Embed(w, r)
+		if got := w.Header().Get("Location"); got != tt.want {
+			t.Errorf("%s: got redirect to %q, want %q", tt.postID, got, tt.want)
+		}
+	}
+}
+
+func TestEmbedOEmbedDiscovery(t *testing.T) {
+	f := useFakeSource(t)
+	f.posts["CEmbedTxt01"] = &scraper.InstaData{
+		Username: "natgeo",
+		Caption:  "Just text",
+		Medias:   []scraper.Media{{TypeName: "GraphImage", URL: "https://scontent.cdninstagram.com/a.jpg", Width: 1080, Height: 1080}},
+	}
+
+	// Highlights come from the reels API, not from sources
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, filepath.Join("scraper", "testdata", "fixtures", "17900000000000001", "reels_media.json"))
+	}))
+	defer srv.Close()
+	oldURL := scraper.InstagramURL
+	scraper.InstagramURL = srv.URL
+	defer func() { scraper.InstagramURL = oldURL }()
+
+	tests := []struct {
+		name, host, target, postURL string
+	}{
+		{name: "text", host: "t.ddinstagram.com", target: "/p/CEmbedTxt01", postURL: "https://www.instagram.com/p/CEmbedTxt01/"},
+		{name: "highlight", host: "ddinstagram.com", target: "/stories/highlights/17900000000000001", postURL: scraper.PostURL(scraper.HighlightID("17900000000000001"))},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		r.Host = tt.host
+		r.Header.Set("User-Agent", "Mozilla/5.0 (compatible; Discordbot/2.0; +https://discordapp.com)")
+		w := httptest.NewRecorder()
+		Embed(w, r)
+
+		body := w.Body.String()
+		want := "/oembed?url=" + url.QueryEscape(tt.postURL)
+		if !strings.Contains(body, want) || !strings.Contains(body, "application/json+oembed") {
+			t.Errorf("%s: no oEmbed discovery link to %s in %s", tt.name, want, body)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	scraper "instafix/handlers/scraper"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// fakeSource answers scrapes from posts, or with the error in errs
+type fakeSource struct {
+	mu    sync.Mutex
+	posts map[string]*scraper.InstaData
+	errs  map[string]error
+	hits  map[string]int
+}
+
+func (*fakeSource) Name() string { return "fake" }
+
+func (f *fakeSource) Fetch(ctx context.Context, postID string) (*scraper.InstaData, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.hits[postID]++
+	if err, ok := f.errs[postID]; ok {
+		return nil, err
+	}
+	item, ok := f.posts[postID]
+	if !ok {
+		return nil, scraper.ErrNotFound
+	}
+	// Scraping rewrites media URLs in place, keep the fixture intact
+	ret := *item
+	ret.PostID = postID
+	ret.Medias = append([]scraper.Media(nil), item.Medias...)
+	return &ret, nil
+}
+
+// Hits returns how many times postID was scraped
+func (f *fakeSource) Hits(postID string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.hits[postID]
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// useFakeSource makes the fake the only scrape source, with a fresh in-memory cache.
+// Fixtures should have dimensions, missing ones fail to probe without touching the network.
+func useFakeSource(t *testing.T) *fakeSource {
+	t.Helper()
+	f := &fakeSource{posts: map[string]*scraper.InstaData{}, errs: map[string]error{}, hits: map[string]int{}}
+	scraper.RegisterSource(f)
+	if err := scraper.SetSources([]string{f.Name()}); err != nil {
+		t.Fatal(err)
+	}
+
+	oldDB := scraper.DB
+	scraper.DB = scraper.NewMemoryCache()
+	scraper.ProbeTransport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		t.Errorf("probed %s, fixtures should have dimensions", r.URL)
+		return nil, errors.New("no network in tests")
+	})
+	t.Cleanup(func() {
+		scraper.DB.Close()
+		scraper.DB = oldDB
+		scraper.ProbeTransport = nil
+		if err := scraper.SetSources(scraper.DefaultSources); err != nil {
+			t.Error(err)
+		}
+	})
+	return f
+}
@@ -1,10 +1,15 @@
 package handlers
 
 import (
+	"context"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"image"
+	"image/color"
 	"image/jpeg"
 	scraper "instafix/handlers/scraper"
+	"instafix/utils"
 	"io"
 	"log/slog"
 	"math"
@@ -12,17 +17,26 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/RyanCarrier/dijkstra/v2"
 	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/image/draw"
-	"golang.org/x/sync/singleflight"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+var (
+	GridTimeout     = 60 * time.Second
+	GridJPEGQuality = 80
 )
 
-var timeout = 60 * time.Second
 var transport = &http.Transport{
 	Proxy: nil, // Skip any proxy
 	DialContext: (&net.Dialer{
@@ -35,7 +49,7 @@ var transport = &http.Transport{
 	TLSHandshakeTimeout:   10 * time.Second,
 	ExpectContinueTimeout: 1 * time.Second,
 }
-var sflightGrid singleflight.Group
+var sflightGrid utils.FlightGroup
 
 // getHeight returns the height of the rows, imagesWH [w,h]
 func getHeight(imagesWH [][]float64, canvasWidth int) float64 {
@@ -74,13 +88,55 @@ func avg(n []float64) float64 {
 	return sum / float64(len(n))
 }
 
-// GenerateGrid generates a grid of images
+// GenerateGrid generates a grid of images, labels are drawn as badges on the image at the same index
 // based on https://blog.vjeux.com/2014/image/google-plus-layout-find-best-breaks.html
-func GenerateGrid(images []image.Image) (image.Image, error) {
+func GenerateGrid(images []image.Image, labels []string, style GridStyle) (image.Image, error) {
+	sizes := make([]image.Point, len(images))
+	for i, img := range images {
+		sizes[i] = img.Bounds().Size()
+	}
+	layout, err := layoutGrid(sizes, style.Gutter)
+	if err != nil {
+		return nil, err
+	}
+	path := layout.path
+
+	canvas := image.NewRGBA(image.Rect(0, 0, layout.width, layout.height))
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(style.Background), image.Point{}, draw.Src)
+
+	gutter := style.Gutter
+	oldRowHeight := gutter
+	for i := 1; i < len(path); i++ {
+		inRow := images[path[i-1]:path[i]]
+		oldImWidth := gutter
+		heightRow := layout.rowHeights[i-1]
+		for n, imageOne := range inRow {
+			newWidth := float64(heightRow) * float64(imageOne.Bounds().Dx()) / float64(imageOne.Bounds().Dy())
+			tile := image.Rect(oldImWidth, oldRowHeight, oldImWidth+int(newWidth), oldRowHeight+int(heightRow))
+			draw.ApproxBiLinear.Scale(canvas, tile, imageOne, imageOne.Bounds(), draw.Src, nil)
+			if label := path[i-1] + n; label < len(labels) && len(labels[label]) > 0 {
+				drawBadge(canvas, tile, labels[label])
+			}
+			oldImWidth += int(newWidth) + gutter
+		}
+		oldRowHeight += heightRow + gutter
+	}
+	return canvas, nil
+}
+
+// gridLayout is where GenerateGrid puts images, rows end at the images in path[1:]
+type gridLayout struct {
+	width, height int
+	path          []int
+	rowHeights    []int
+}
+
+// layoutGrid splits images of sizes into rows, so the size of a grid is known without drawing it
+func layoutGrid(sizes []image.Point, gutter int) (gridLayout, error) {
 	var imagesWH [][]float64
-	images = append(images, image.Rect(0, 0, 0, 0)) // Needed as for some reason the last image is not added
-	for _, image := range images {
-		imagesWH = append(imagesWH, []float64{float64(image.Bounds().Dx()), float64(image.Bounds().Dy())})
+	sizes = append(sizes, image.Point{}) // Needed as for some reason the last image is not added
+	for _, size := range sizes {
+		imagesWH = append(imagesWH, []float64{float64(size.X), float64(size.Y)})
 	}
 
 	// Calculate canvas width by taking the average of width of all images
@@ -92,99 +148,297 @@ func GenerateGrid(images []image.Image) (image.Image, error) {
 	canvasWidth := int(avg(allWidth) * 1.5)
 
 	graph := dijkstra.NewGraph()
-	for i := range images {
+	for i := range sizes {
 		graph.AddVertexAndArcs(i, createGraph(imagesWH, i, canvasWidth))
 	}
 
-	// Get the shortest path from 0 to len(images)-1
-	best, err := graph.Shortest(0, len(images)-1)
+	// Get the shortest path from 0 to len(sizes)-1
+	best, err := graph.Shortest(0, len(sizes)-1)
 	if err != nil {
-		return nil, err
+		return gridLayout{}, err
 	}
 	path := best.Path
 
-	canvasHeight := 0
+	// Gutters go around every image, rows are scaled to the width left between them
+	canvasHeight := gutter
 	var heightRows []int
 	// Calculate height of each row and canvas height
 	for i := 1; i < len(path); i++ {
 		if len(imagesWH) < path[i-1] {
-			return nil, errors.New("imagesWH is not long enough")
+			return gridLayout{}, errors.New("imagesWH is not long enough")
 		}
 		rowWH := imagesWH[path[i-1]:path[i]]
 
-		rowHeight := int(getHeight(rowWH, canvasWidth))
+		rowHeight := int(getHeight(rowWH, canvasWidth-gutter*(len(rowWH)+1)))
 		heightRows = append(heightRows, rowHeight)
-		canvasHeight += rowHeight
+		canvasHeight += rowHeight + gutter
 	}
+	return gridLayout{width: canvasWidth, height: canvasHeight, path: path, rowHeights: heightRows}, nil
+}
 
-	canvas := image.NewRGBA(image.Rect(0, 0, canvasWidth, canvasHeight))
+// gridSize returns the size of the grid of tiles, false if a tile's size isn't known
+func gridSize(tiles []gridTile, style GridStyle) (int, int, bool) {
+	sizes := make([]image.Point, len(tiles))
+	for i, tile := range tiles {
+		if tile.Width <= 0 || tile.Height <= 0 {
+			return 0, 0, false
+		}
+		sizes[i] = image.Pt(tile.Width, tile.Height)
+	}
+	layout, err := layoutGrid(sizes, style.Gutter)
+	if err != nil {
+		return 0, 0, false
+	}
+	return layout.width, layout.height, true
+}
 
-	oldRowHeight := 0
-	for i := 1; i < len(path); i++ {
-		inRow := images[path[i-1]:path[i]]
-		oldImWidth := 0
-		if len(heightRows) < i {
-			return nil, errors.New("heightRows is not long enough")
+// drawBadge draws label in the top left corner of tile, scaled up with the tile so it stays readable
+func drawBadge(canvas *image.RGBA, tile image.Rectangle, label string) {
+	face := basicfont.Face7x13
+	metrics := face.Metrics()
+	badge := image.NewRGBA(image.Rect(0, 0, font.MeasureString(face, label).Ceil()+4, metrics.Height.Ceil()+3))
+	draw.Draw(badge, badge.Bounds(), image.NewUniform(color.RGBA{0, 0, 0, 160}), image.Point{}, draw.Src)
+	d := font.Drawer{
+		Dst:  badge,
+		Src:  image.NewUniform(color.RGBA{255, 255, 255, 255}),
+		Face: face,
+		Dot:  fixed.P(2, 2+metrics.Ascent.Ceil()),
+	}
+	d.DrawString(label)
+
+	// Whole scales keep the bitmap font sharp, an eighth of the tile height is readable at thumbnail size
+	scale := min(tile.Dy()/(8*badge.Bounds().Dy()), tile.Dx()/(4*badge.Bounds().Dx()))
+	scale = max(1, scale)
+	margin := image.Pt(2*scale, 2*scale)
+	dst := image.Rectangle{Min: tile.Min.Add(margin), Max: tile.Min.Add(margin).Add(badge.Bounds().Size().Mul(scale))}
+	draw.NearestNeighbor.Scale(canvas, dst, badge, badge.Bounds(), draw.Over, nil)
+}
+
+// maskFunc is an image mask, opaque where it returns true
+type maskFunc func(x, y int) bool
+
+func (m maskFunc) ColorModel() color.Model { return color.AlphaModel }
+func (m maskFunc) Bounds() image.Rectangle {
+	return image.Rect(math.MinInt32, math.MinInt32, math.MaxInt32, math.MaxInt32)
+}
+func (m maskFunc) At(x, y int) color.Color {
+	if m(x, y) {
+		return color.Opaque
+	}
+	return color.Transparent
+}
+
+// drawPlayIcon returns a copy of img with a play button in the middle, to tell videos apart in grids
+func drawPlayIcon(img image.Image) image.Image {
+	b := img.Bounds()
+	canvas := image.NewRGBA(b)
+	draw.Draw(canvas, b, img, b.Min, draw.Src)
+
+	// Circle a fifth of the shorter side wide, scaled down along with the image
+	radius := max(1, min(b.Dx(), b.Dy())/10)
+	center := image.Pt(b.Min.X+b.Dx()/2, b.Min.Y+b.Dy()/2)
+	circle := image.Rectangle{Min: center.Sub(image.Pt(radius, radius)), Max: center.Add(image.Pt(radius, radius))}
+	draw.DrawMask(canvas, circle, image.NewUniform(color.RGBA{0, 0, 0, 140}), image.Point{}, maskFunc(func(x, y int) bool {
+		dx, dy := x-center.X, y-center.Y
+		return dx*dx+dy*dy <= radius*radius
+	}), circle.Min, draw.Over)
+
+	// Triangle pointing right, shifted so it looks centered in the circle
+	width, half := radius*9/10, radius/2
+	left := center.X - width/3
+	triangle := image.Rect(left, center.Y-half, left+width, center.Y+half)
+	draw.DrawMask(canvas, triangle, image.NewUniform(color.RGBA{230, 230, 230, 230}), image.Point{}, maskFunc(func(x, y int) bool {
+		dy := y - center.Y
+		if dy < 0 {
+			dy = -dy
 		}
-		heightRow := heightRows[i-1]
-		for _, imageOne := range inRow {
-			newWidth := float64(heightRow) * float64(imageOne.Bounds().Dx()) / float64(imageOne.Bounds().Dy())
-			draw.ApproxBiLinear.Scale(canvas, image.Rect(oldImWidth, oldRowHeight, oldImWidth+int(newWidth), oldRowHeight+int(heightRow)), imageOne, imageOne.Bounds(), draw.Src, nil)
-			oldImWidth += int(newWidth)
+		return dy*width <= half*(width-(x-left))
+	}), triangle.Min, draw.Over)
+	return canvas
+}
+
+// GridStyle is how a grid is drawn, picked with query params of the grid routes
+type GridStyle struct {
+	Numbered   bool       // ?numbers=1, slide number badge on every image
+	Gutter     int        // ?gutter=8, pixels between and around images
+	Background color.RGBA // ?bg=ffffff, behind gutters and gaps
+}
+
+var (
+	defaultGridStyle = GridStyle{Background: color.RGBA{0, 0, 0, 255}}
+
+	// Every style is rendered and stored once per grid, so only a few are allowed
+	gridGutters     = []int{0, 8, 16, 32}
+	gridBackgrounds = map[string]color.RGBA{
+		"black": {0, 0, 0, 255},
+		"white": {255, 255, 255, 255},
+		"gray":  {128, 128, 128, 255},
+	}
+
+	// Variants are stored next to the default grid as {key}+{variant}.jpeg
+	gridVariantSep = "+"
+)
+
+// parseGridStyle reads the style of a grid from the query of r
+func parseGridStyle(r *http.Request) (GridStyle, error) {
+	style := defaultGridStyle
+	query := r.URL.Query()
+	if v := query.Get("numbers"); len(v) > 0 {
+		numbered, err := strconv.ParseBool(v)
+		if err != nil {
+			return style, errors.New("invalid numbers parameter")
 		}
-		oldRowHeight += heightRow
+		style.Numbered = numbered
 	}
-	return canvas, nil
+	if v := query.Get("gutter"); len(v) > 0 {
+		gutter, err := strconv.Atoi(v)
+		if err != nil || !slices.Contains(gridGutters, gutter) {
+			return style, fmt.Errorf("invalid gutter parameter, must be one of %v", gridGutters)
+		}
+		style.Gutter = gutter
+	}
+	if v := query.Get("bg"); len(v) > 0 {
+		bg, ok := gridBackground(v)
+		if !ok {
+			return style, errors.New("invalid bg parameter, must be black, white or gray, or its hex color like ffffff")
+		}
+		style.Background = bg
+	}
+	return style, nil
+}
+
+// gridBackground returns the allowed background named v, or with v as hex color
+func gridBackground(v string) (color.RGBA, bool) {
+	v = strings.ToLower(v)
+	if bg, ok := gridBackgrounds[v]; ok {
+		return bg, true
+	}
+	b, err := hex.DecodeString(strings.TrimPrefix(v, "#"))
+	if err != nil || len(b) != 3 {
+		return color.RGBA{}, false
+	}
+	for _, bg := range gridBackgrounds {
+		if bg == (color.RGBA{b[0], b[1], b[2], 255}) {
+			return bg, true
+		}
+	}
+	return color.RGBA{}, false
+}
+
+// variant returns what tells grids of style apart from the default one in their key, empty for the default
+func (s GridStyle) variant() string {
+	var parts []string
+	if s.Numbered {
+		parts = append(parts, "n")
+	}
+	if s.Gutter > 0 {
+		parts = append(parts, "g"+strconv.Itoa(s.Gutter))
+	}
+	if s.Background != defaultGridStyle.Background {
+		bg := s.Background
+		parts = append(parts, "b"+hex.EncodeToString([]byte{bg.R, bg.G, bg.B}))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return gridVariantSep + strings.Join(parts, gridVariantSep)
+}
+
+// gridPath returns where the grid of key is stored, keys may have colons (story:, profile:)
+func gridPath(key string) string {
+	return filepath.Join(scraper.StaticDir, strings.ReplaceAll(key, ":", "_")+".jpeg")
+}
+
+// serveCachedGrid writes the grid in gridFname if it is still in the LRU
+func serveCachedGrid(w http.ResponseWriter, gridFname string) (bool, error) {
+	if _, ok := scraper.LRU.Get(gridFname); !ok {
+		return false, nil
+	}
+	f, err := os.Open(gridFname)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "image/jpeg")
+	io.Copy(w, f)
+	return true, nil
 }
 
 func Grid(w http.ResponseWriter, r *http.Request) {
 	postID := chi.URLParam(r, "postID")
-	gridFname := filepath.Join("static", postID+".jpeg")
+	style, err := parseGridStyle(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	gridFname := gridPath(postID + style.variant())
 
 	// If already exists, return from cache
-	if _, ok := scraper.LRU.Get(gridFname); ok {
-		f, err := os.Open(gridFname)
-		if err != nil && !errors.Is(err, os.ErrNotExist) {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		} else if err == nil {
-			defer f.Close()
-			w.Header().Set("Content-Type", "image/jpeg")
-			io.Copy(w, f)
-			return
-		}
+	if ok, err := serveCachedGrid(w, gridFname); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if ok {
+		return
 	}
 
-	item, err := scraper.GetData(postID)
+	item, err := scraper.GetData(r.Context(), postID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Filter media only include image
-	var mediaURLs []string
-	for _, media := range item.Medias {
-		if !strings.Contains(media.TypeName, "Image") {
-			continue
+	tiles := gridTiles(item)
+	if len(tiles) == 0 {
+		http.NotFound(w, r)
+		return
+	} else if len(tiles) == 1 {
+		single := "/images/" + postID + "/" + strconv.Itoa(tiles[0].Num)
+		if tiles[0].IsVideo {
+			single = "/thumbnails/" + postID + "/" + strconv.Itoa(tiles[0].Num)
 		}
-		mediaURLs = append(mediaURLs, media.URL)
+		http.Redirect(w, r, single, http.StatusFound)
+		return
 	}
+	serveGrid(w, r, postID, gridFname, tiles, style)
+}
 
-	if len(item.Medias) == 1 || len(mediaURLs) == 1 {
-		http.Redirect(w, r, "/images/"+postID+"/1", http.StatusFound)
-		return
+// gridTiles returns the slides of item a grid can draw, videos are drawn from their poster with a play icon
+func gridTiles(item *scraper.InstaData) []gridTile {
+	var tiles []gridTile
+	for n, media := range item.Medias {
+		switch {
+		case media.IsImage():
+			tiles = append(tiles, gridTile{URL: media.URL, Num: n + 1, Width: media.Width, Height: media.Height})
+		case len(media.ThumbnailURL) > 0:
+			tiles = append(tiles, gridTile{URL: media.ThumbnailURL, IsVideo: true, Num: n + 1, Width: media.Width, Height: media.Height})
+		}
 	}
+	return tiles
+}
+
+// gridTile is an image to download for a grid
+type gridTile struct {
+	URL           string
+	IsVideo       bool // Poster of a video, drawn with a play icon
+	Num           int  // Slide number shown by numbered grids
+	Width, Height int  // Of the slide, 0 when unknown
+}
 
-	_, err, _ = sflightGrid.Do(postID, func() (interface{}, error) {
+// serveGrid renders tiles with style into gridFname once and writes it
+func serveGrid(w http.ResponseWriter, r *http.Request, key, gridFname string, tiles []gridTile, style GridStyle) {
+	_, err, _ := sflightGrid.Do(r.Context(), gridFname, func(ctx context.Context) (interface{}, error) {
+		defer prometheus.NewTimer(gridRenderDuration).ObserveDuration()
 		var wg sync.WaitGroup
-		images := make([]image.Image, len(mediaURLs))
-		for i, mediaURL := range mediaURLs {
+		images := make([]image.Image, len(tiles))
+		for i, tile := range tiles {
 			wg.Add(1)
 
-			go func(i int, url string) {
+			go func(i int, tile gridTile) {
 				defer wg.Done()
-				client := http.Client{Transport: transport, Timeout: timeout}
-				req, err := http.NewRequest(http.MethodGet, url, http.NoBody)
+				client := http.Client{Transport: transport, Timeout: GridTimeout}
+				req, err := http.NewRequestWithContext(ctx, http.MethodGet, tile.URL, http.NoBody)
 				if err != nil {
 					return
 				}
@@ -192,22 +446,47 @@ func Grid(w http.ResponseWriter, r *http.Request) {
 				// Make request client.Get
 				res, err := client.Do(req)
 				if err != nil {
-					slog.Error("Failed to get image", "postID", postID, "err", err)
+					slog.Error("Failed to get image", "key", key, "err", err)
+					gridDecodeFailures.Inc()
 					return
 				}
 				defer res.Body.Close()
 
-				images[i], err = jpeg.Decode(res.Body)
+				img, err := jpeg.Decode(res.Body)
 				if err != nil {
-					slog.Error("Failed to decode image", "postID", postID, "err", err)
+					slog.Error("Failed to decode image", "key", key, "err", err)
+					gridDecodeFailures.Inc()
 					return
 				}
-			}(i, mediaURL)
+				if tile.IsVideo {
+					img = drawPlayIcon(img)
+				}
+				images[i] = img
+			}(i, tile)
 		}
 		wg.Wait()
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+
+		// Leave out images that failed, rather than the whole grid
+		var downloaded []image.Image
+		var labels []string
+		for i, img := range images {
+			if img == nil {
+				continue
+			}
+			downloaded = append(downloaded, img)
+			if style.Numbered {
+				labels = append(labels, strconv.Itoa(tiles[i].Num))
+			}
+		}
+		if len(downloaded) == 0 {
+			return false, errors.New("no image of the grid could be downloaded")
+		}
 
 		// Create grid Images
-		grid, err := GenerateGrid(images)
+		grid, err := GenerateGrid(downloaded, labels, style)
 		if err != nil {
 			return false, err
 		}
@@ -219,7 +498,7 @@ func Grid(w http.ResponseWriter, r *http.Request) {
 		}
 		defer f.Close()
 
-		if err := jpeg.Encode(f, grid, &jpeg.Options{Quality: 80}); err != nil {
+		if err := jpeg.Encode(f, grid, &jpeg.Options{Quality: GridJPEGQuality}); err != nil {
 			return false, err
 		}
 		scraper.LRU.Add(gridFname, true)
@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"image"
+	"image/color"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/image/draw"
+)
+
+func TestDrawPlayIcon(t *testing.T) {
+	src := image.NewUniform(color.RGBA{255, 0, 0, 255})
+	img := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 200; x++ {
+			img.Set(x, y, src.C)
+		}
+	}
+
+	got := drawPlayIcon(img)
+	if got.Bounds() != img.Bounds() {
+		t.Fatalf("got bounds %v, want %v", got.Bounds(), img.Bounds())
+	}
+	if r, g, b, _ := got.At(100, 50).RGBA(); r>>8 < 200 || g>>8 < 200 || b>>8 < 200 {
+		t.Errorf("center is %v, want the light triangle", got.At(100, 50))
+	}
+	for _, p := range []image.Point{{0, 0}, {199, 0}, {0, 99}, {199, 99}} {
+		if got.At(p.X, p.Y) != img.At(p.X, p.Y) {
+			t.Errorf("corner %v is %v, want it unchanged", p, got.At(p.X, p.Y))
+		}
+	}
+	if img.At(100, 50) != src.C {
+		t.Error("source image was modified")
+	}
+}
+
+func TestParseGridStyle(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    GridStyle
+		variant string
+		wantErr bool
+	}{
+		{query: "", want: defaultGridStyle, variant: ""},
+		{query: "numbers=1", want: GridStyle{Numbered: true, Background: defaultGridStyle.Background}, variant: "+n"},
+		{query: "numbers=false&gutter=0&bg=000000", want: defaultGridStyle, variant: ""},
+		{query: "gutter=8&bg=%23FFFFFF", want: GridStyle{Gutter: 8, Background: color.RGBA{255, 255, 255, 255}}, variant: "+g8+bffffff"},
+		{query: "numbers=yes", wantErr: true},
+		{query: "gutter=-1", wantErr: true},
+		{query: "gutter=16&bg=Gray", want: GridStyle{Gutter: 16, Background: color.RGBA{128, 128, 128, 255}}, variant: "+g16+b808080"},
+		{query: "bg=black", want: defaultGridStyle, variant: ""},
+		{query: "gutter=65", wantErr: true},
+		{query: "gutter=9", wantErr: true},
+		{query: "bg=fff", wantErr: true},
+		{query: "bg=zzzzzz", wantErr: true},
+		{query: "bg=fffffe", wantErr: true},
+		{query: "bg=pink", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseGridStyle(httptest.NewRequest("GET", "/grid/C1?"+tt.query, nil))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: got %+v, want error", tt.query, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.query, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q: got %+v, want %+v", tt.query, got, tt.want)
+		}
+		if got.variant() != tt.variant {
+			t.Errorf("%q: got variant %q, want %q", tt.query, got.variant(), tt.variant)
+		}
+	}
+}
+
+func TestGenerateGridStyle(t *testing.T) {
+	red := image.NewUniform(color.RGBA{255, 0, 0, 255})
+	images := make([]image.Image, 3)
+	for i := range images {
+		img := image.NewRGBA(image.Rect(0, 0, 300, 300))
+		draw.Draw(img, img.Bounds(), red, image.Point{}, draw.Src)
+		images[i] = img
+	}
+	white := color.RGBA{255, 255, 255, 255}
+
+	grid, err := GenerateGrid(images, []string{"1", "2", "3"}, GridStyle{Numbered: true, Gutter: 10, Background: white})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := grid.Bounds()
+	for _, p := range []image.Point{{0, 0}, {5, b.Dy() / 2}, {b.Dx() - 1, b.Dy() - 1}} {
+		if got := grid.At(p.X, p.Y); got != white {
+			t.Errorf("gutter at %v is %v, want the background", p, got)
+		}
+	}
+
+	// The badge is dark, the rest of the image is untouched
+	if r, _, _, _ := grid.At(13, 13).RGBA(); r>>8 > 128 {
+		t.Errorf("badge at (13, 13) is %v, want it dark", grid.At(13, 13))
+	}
+	if got := grid.At(b.Dx()/2, b.Dy()-20); got != red.C {
+		t.Errorf("image at the bottom is %v, want it red", got)
+	}
+}
+
+func TestGridSize(t *testing.T) {
+	tests := [][]image.Point{
+		{{1080, 1080}, {1080, 1920}},
+		{{1080, 1350}, {1080, 1350}, {1080, 1350}},
+		{{1080, 1080}, {640, 480}, {1080, 1920}, {1080, 1350}, {720, 1280}},
+	}
+	for _, sizes := range tests {
+		var images []image.Image
+		var tiles []gridTile
+		for _, size := range sizes {
+			images = append(images, image.NewRGBA(image.Rectangle{Max: size}))
+			tiles = append(tiles, gridTile{Width: size.X, Height: size.Y})
+		}
+		grid, err := GenerateGrid(images, nil, GridStyle{Gutter: 8})
+		if err != nil {
+			t.Fatal(err)
+		}
+		width, height, ok := gridSize(tiles, GridStyle{Gutter: 8})
+		if !ok || width != grid.Bounds().Dx() || height != grid.Bounds().Dy() {
+			t.Errorf("%v: got %dx%d, want %dx%d", sizes, width, height, grid.Bounds().Dx(), grid.Bounds().Dy())
+		}
+	}
+
+	if _, _, ok := gridSize([]gridTile{{Width: 1080, Height: 1080}, {}}, defaultGridStyle); ok {
+		t.Error("got a size with a tile of unknown size")
+	}
+}
@@ -16,7 +16,7 @@ func Images(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	item, err := scraper.GetData(postID)
+	item, err := scraper.GetData(r.Context(), postID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -27,5 +27,9 @@ func Images(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	imageURL := item.Medias[max(1, mediaNum)-1].URL
+	if ProxyMedia {
+		proxyMediaURL(w, r, imageURL)
+		return
+	}
 	http.Redirect(w, r, imageURL, http.StatusFound)
 }
@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"instafix/utils"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "instafix_http_requests_total",
+		Help: "HTTP requests by route pattern and bot family of the User-Agent.",
+	}, []string{"route", "bot"})
+	gridRenderDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "instafix_grid_render_duration_seconds",
+		Help:    "Time to download, decode and render a grid image.",
+		Buckets: prometheus.DefBuckets,
+	})
+	gridDecodeFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "instafix_grid_decode_failures_total",
+		Help: "Images that failed to download or decode while rendering a grid.",
+	})
+)
+
+func init() {
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name:        "instafix_singleflight_deduplicated_total",
+		Help:        "Calls that joined an in-flight call instead of doing the work again.",
+		ConstLabels: prometheus.Labels{"group": "grid"},
+	}, func() float64 { return float64(sflightGrid.Deduplicated()) })
+}
+
+// Metrics counts requests per route, the route is only known once chi has routed them
+func Metrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		httpRequests.WithLabelValues(route, utils.BotFamily(r.Header.Get("User-Agent"))).Inc()
+	})
+}
@@ -1,29 +1,150 @@
 package handlers
 
 import (
+	"context"
+	"errors"
+	"html"
+	scraper "instafix/handlers/scraper"
 	"instafix/utils"
 	"instafix/views"
 	"instafix/views/model"
 	"net/http"
+	"strconv"
+	"time"
 )
 
+// scaleToFit scales width x height down to fit in maxWidth x maxHeight, keeping the aspect ratio.
+// Zero max means no limit.
+func scaleToFit(width, height, maxWidth, maxHeight int) (int, int) {
+	if maxWidth > 0 && width > maxWidth {
+		height = height * maxWidth / width
+		width = maxWidth
+	}
+	if maxHeight > 0 && height > maxHeight {
+		width = width * maxHeight / height
+		height = maxHeight
+	}
+	return width, height
+}
+
+// OEmbed is an oEmbed provider for Instagram post URLs, see https://oembed.com
 func OEmbed(w http.ResponseWriter, r *http.Request) {
 	urlQuery := r.URL.Query()
-	if urlQuery == nil {
+	format := urlQuery.Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "xml" {
+		http.Error(w, "format not supported", http.StatusNotImplemented)
 		return
 	}
-	headingText := urlQuery.Get("text")
-	headingURL := urlQuery.Get("url")
-	if headingText == "" || headingURL == "" {
+
+	postURL := urlQuery.Get("url")
+	link, err := utils.ParseLink(postURL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
+	postID, err := resolveLink(r.Context(), link)
+	if errors.Is(err, errNoPost) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), apiErrorStatus(err))
+		return
+	}
+	mediaNum := link.MediaNum
+	maxWidth, _ := strconv.Atoi(urlQuery.Get("maxwidth"))
+	maxHeight, _ := strconv.Atoi(urlQuery.Get("maxheight"))
+
+	item, err := scraper.GetData(r.Context(), postID)
+	if errors.Is(err, context.Canceled) {
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), apiErrorStatus(err))
+		return
+	}
+	if mediaNum > len(item.Medias) {
+		http.Error(w, "media number out of range", http.StatusNotFound)
+		return
+	}
+
+	// Like embeds, a carousel the grid can't draw two slides of is its first video
+	if mediaNum == 0 && len(item.Medias) > 1 && len(gridTiles(item)) < 2 {
+		for n, m := range item.Medias {
+			if !m.IsImage() {
+				mediaNum = n + 1
+				break
+			}
+		}
+	}
+
+	base := baseURL(r)
+	media := item.Medias[max(1, mediaNum)-1]
+	width, height := media.Width, media.Height
+	if width == 0 || height == 0 {
+		width, height = 400, 400
+	}
+	// A grid is as big as the slides laid out, not the first one
+	isGrid := mediaNum == 0 && len(item.Medias) > 1
+	if isGrid {
+		if gridWidth, gridHeight, ok := gridSize(gridTiles(item), defaultGridStyle); ok {
+			width, height = gridWidth, gridHeight
+		}
+	}
+	width, height = scaleToFit(width, height, maxWidth, maxHeight)
 
-	// Totally safe 100% valid template 👍
-	OEmbedData := &model.OEmbedData{
-		Text: utils.EscapeJSONString(headingText),
-		URL:  headingURL,
+	data := &model.OEmbedData{
+		Version:      "1.0",
+		AuthorName:   "@" + item.Username,
+		AuthorURL:    "https://www.instagram.com/" + item.Username + "/",
+		ProviderName: "InstaFix",
+		ProviderURL:  "https://github.com/Wikidepia/InstaFix",
+		CacheAge:     max(0, int(time.Until(item.FreshUntil()).Seconds())),
+		Width:        width,
+		Height:       height,
+	}
+	data.Title = item.Caption
+	if len(data.Title) > 255 {
+		data.Title = utils.Substr(data.Title, 0, 250) + "..."
+	}
+
+	mediaPath := postID + "/" + strconv.Itoa(max(1, mediaNum))
+	switch {
+	case isGrid:
+		data.Type = "rich"
+		data.ThumbnailURL = base + "/grid/" + postID
+		data.HTML = `<a href="` + html.EscapeString(postURL) + `"><img src="` + html.EscapeString(data.ThumbnailURL) +
+			`" width="` + strconv.Itoa(width) + `" height="` + strconv.Itoa(height) + `" alt="` + html.EscapeString(data.AuthorName) + `"></a>`
+	case media.IsImage():
+		data.Type = "photo"
+		data.URL = base + "/images/" + mediaPath
+		data.ThumbnailURL = data.URL
+	default:
+		data.Type = "video"
+		// Discord shows author_name above videos, embeds ask for the caption to be shown there
+		if captioned, _ := strconv.ParseBool(urlQuery.Get("caption")); captioned {
+			if description := postDescription(item); len(description) > 0 {
+				data.AuthorName = description
+			}
+		}
+		var poster string
+		if len(media.ThumbnailURL) > 0 {
+			data.ThumbnailURL = base + "/thumbnails/" + mediaPath
+			poster = `" poster="` + html.EscapeString(data.ThumbnailURL)
+		}
+		data.HTML = `<video src="` + html.EscapeString(base+"/videos/"+mediaPath) + poster +
+			`" width="` + strconv.Itoa(width) + `" height="` + strconv.Itoa(height) + `" controls></video>`
+	}
+	if len(data.ThumbnailURL) > 0 {
+		data.ThumbnailWidth, data.ThumbnailHeight = width, height
 	}
 
-	views.OEmbed(OEmbedData, w)
+	if format == "xml" {
+		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		views.OEmbedXML(data, w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	views.OEmbed(data, w)
 }
@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	scraper "instafix/handlers/scraper"
+	"instafix/views/model"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestScaleToFit(t *testing.T) {
+	tests := []struct {
+		width, height, maxWidth, maxHeight int
+		wantWidth, wantHeight              int
+	}{
+		{1080, 1350, 0, 0, 1080, 1350},
+		{1080, 1350, 540, 0, 540, 675},
+		{1080, 1350, 0, 675, 540, 675},
+		{1080, 1350, 540, 300, 240, 300},
+		{400, 400, 1000, 1000, 400, 400},
+	}
+	for _, tt := range tests {
+		w, h := scaleToFit(tt.width, tt.height, tt.maxWidth, tt.maxHeight)
+		if w != tt.wantWidth || h != tt.wantHeight {
+			t.Errorf("scaleToFit(%d, %d, %d, %d) = %d, %d, want %d, %d",
+				tt.width, tt.height, tt.maxWidth, tt.maxHeight, w, h, tt.wantWidth, tt.wantHeight)
+		}
+	}
+}
+
+func oembedGet(query url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "http://ddinstagram.com/oembed?"+query.Encode(), nil)
+	w := httptest.NewRecorder()
+	OEmbed(w, r)
+	return w
+}
+
+func TestOEmbed(t *testing.T) {
+	f := useFakeSource(t)
+	f.posts["COEmbedImg1"] = &scraper.InstaData{
+		Username: "natgeo",
+		Caption:  "A photo",
+		Medias:   []scraper.Media{{TypeName: "GraphImage", URL: "https://scontent.cdninstagram.com/a.jpg", Width: 1080, Height: 1350}},
+	}
+	f.posts["COEmbedVid1"] = &scraper.InstaData{
+		Username: "natgeo",
+		Caption:  "A video",
+		Likes:    1200,
+		Medias:   []scraper.Media{{TypeName: "GraphVideo", URL: "https://scontent.cdninstagram.com/b.mp4", ThumbnailURL: "https://scontent.cdninstagram.com/b.jpg", Width: 1080, Height: 1920}},
+	}
+	f.posts["COEmbedCar1"] = &scraper.InstaData{
+		Username: "natgeo",
+		Medias: []scraper.Media{
+			{TypeName: "GraphImage", URL: "https://scontent.cdninstagram.com/c.jpg", Width: 1080, Height: 1080},
+			{TypeName: "GraphVideo", URL: "https://scontent.cdninstagram.com/d.mp4", ThumbnailURL: "https://scontent.cdninstagram.com/d.jpg", Width: 1080, Height: 1920},
+		},
+	}
+	f.posts["COEmbedCar2"] = &scraper.InstaData{
+		Username: "natgeo",
+		Medias: []scraper.Media{
+			{TypeName: "GraphVideo", URL: "https://scontent.cdninstagram.com/e.mp4", Width: 1080, Height: 1920},
+			{TypeName: "GraphVideo", URL: "https://scontent.cdninstagram.com/f.mp4", Width: 1080, Height: 1920},
+		},
+	}
+
+	tests := []struct {
+		name  string
+		query url.Values
+		want  model.OEmbedData
+	}{
+		{
+			name:  "photo",
+			query: url.Values{"url": {"https://www.instagram.com/p/COEmbedImg1/"}},
+			want: model.OEmbedData{
+				Type: "photo", AuthorName: "@natgeo", Width: 1080, Height: 1350,
+				URL: "http://ddinstagram.com/images/COEmbedImg1/1", ThumbnailURL: "http://ddinstagram.com/images/COEmbedImg1/1",
+			},
+		},
+		{
+			name:  "photo maxwidth",
+			query: url.Values{"url": {"https://www.instagram.com/p/COEmbedImg1/"}, "maxwidth": {"540"}},
+			want: model.OEmbedData{
+				Type: "photo", AuthorName: "@natgeo", Width: 540, Height: 675,
+				URL: "http://ddinstagram.com/images/COEmbedImg1/1", ThumbnailURL: "http://ddinstagram.com/images/COEmbedImg1/1",
+			},
+		},
+		{
+			name:  "video maxheight",
+			query: url.Values{"url": {"https://www.instagram.com/reel/COEmbedVid1/"}, "maxheight": {"960"}},
+			want: model.OEmbedData{
+				Type: "video", AuthorName: "@natgeo", Width: 540, Height: 960,
+				ThumbnailURL: "http://ddinstagram.com/thumbnails/COEmbedVid1/1",
+			},
+		},
+		{
+			// Only the cached caption is shown, never text from the request
+			name:  "video caption",
+			query: url.Values{"url": {"https://www.instagram.com/reel/COEmbedVid1/"}, "caption": {"1"}, "text": {"spoofed"}},
+			want: model.OEmbedData{
+				Type: "video", AuthorName: "A video\n\n❤️ 1.2K", Width: 1080, Height: 1920,
+				ThumbnailURL: "http://ddinstagram.com/thumbnails/COEmbedVid1/1",
+			},
+		},
+		{
+			name:  "carousel",
+			query: url.Values{"url": {"https://www.instagram.com/p/COEmbedCar1/"}},
+			want: model.OEmbedData{
+				Type: "rich", AuthorName: "@natgeo", Width: 1080, Height: 691,
+				ThumbnailURL: "http://ddinstagram.com/grid/COEmbedCar1",
+			},
+		},
+		{
+			name:  "carousel maxwidth",
+			query: url.Values{"url": {"https://www.instagram.com/p/COEmbedCar1/"}, "maxwidth": {"540"}},
+			want: model.OEmbedData{
+				Type: "rich", AuthorName: "@natgeo", Width: 540, Height: 345,
+				ThumbnailURL: "http://ddinstagram.com/grid/COEmbedCar1",
+			},
+		},
+		{
+			// No slide has a poster to draw in the grid
+			name:  "carousel of videos",
+			query: url.Values{"url": {"https://www.instagram.com/p/COEmbedCar2/"}},
+			want:  model.OEmbedData{Type: "video", AuthorName: "@natgeo", Width: 1080, Height: 1920},
+		},
+		{
+			name:  "carousel slide",
+			query: url.Values{"url": {"https://www.instagram.com/p/COEmbedCar1/?img_index=2"}},
+			want: model.OEmbedData{
+				Type: "video", AuthorName: "@natgeo", Width: 1080, Height: 1920,
+				ThumbnailURL: "http://ddinstagram.com/thumbnails/COEmbedCar1/2",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, format := range []string{"json", "xml"} {
+				query := url.Values{"format": {format}}
+				for k, v := range tt.query {
+					query[k] = v
+				}
+				w := oembedGet(query)
+				if w.Code != http.StatusOK {
+					t.Fatalf("%s: got status %d: %s", format, w.Code, w.Body)
+				}
+
+				var got model.OEmbedData
+				var err error
+				if format == "xml" {
+					if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/xml") {
+						t.Errorf("xml: got Content-Type %q", ct)
+					}
+					err = xml.Unmarshal(w.Body.Bytes(), &got)
+				} else {
+					err = json.Unmarshal(w.Body.Bytes(), &got)
+				}
+				if err != nil {
+					t.Fatalf("%s: %v", format, err)
+				}
+
+				if got.Version != "1.0" || got.Type != tt.want.Type || got.AuthorName != tt.want.AuthorName ||
+					got.URL != tt.want.URL || got.ThumbnailURL != tt.want.ThumbnailURL {
+					t.Errorf("%s: got %+v, want %+v", format, got, tt.want)
+				}
+				if got.Width != tt.want.Width || got.Height != tt.want.Height {
+					t.Errorf("%s: got %dx%d, want %dx%d", format, got.Width, got.Height, tt.want.Width, tt.want.Height)
+				}
+				if got.Type != "photo" && len(got.HTML) == 0 {
+					t.Errorf("%s: %s has no html", format, got.Type)
+				}
+			}
+		})
+	}
+}
+
+func TestOEmbedErrors(t *testing.T) {
+	useFakeSource(t)
+	tests := []struct {
+		query url.Values
+		want  int
+	}{
+		{query: url.Values{"url": {"https://www.instagram.com/p/COEmbedNone/"}, "format": {"yaml"}}, want: http.StatusNotImplemented},
+		{query: url.Values{"url": {"https://example.com/"}}, want: http.StatusNotFound},
+		{query: url.Values{"url": {"https://www.instagram.com/p/COEmbedNone/"}}, want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if w := oembedGet(tt.query); w.Code != tt.want {
+			t.Errorf("%s: got status %d, want %d", tt.query.Encode(), w.Code, tt.want)
+		}
+	}
+}
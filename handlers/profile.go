@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"errors"
+	scraper "instafix/handlers/scraper"
+	"instafix/utils"
+	"instafix/views"
+	"instafix/views/model"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// profileStats returns the followers, following and posts line appended to the biography
+func profileStats(p *scraper.Profile) string {
+	stats := "👥 " + utils.FormatCount(p.Followers) + " followers · " +
+		utils.FormatCount(p.Following) + " following · " +
+		utils.FormatCount(p.Posts) + " posts"
+	if p.IsPrivate {
+		stats += "\n🔒 Private account"
+	}
+	return stats
+}
+
+// embedProfile renders the embed of a profile, gallery mode shows the latest posts instead of the avatar
+func embedProfile(w http.ResponseWriter, r *http.Request, viewsData *model.ViewsData, username string, modes embedModes) {
+	profile, err := scraper.GetProfile(r.Context(), username)
+	if err != nil {
+		switch {
+		case errors.Is(err, scraper.ErrNotFound):
+			viewsData.Description = "Profile not found."
+		case errors.Is(err, scraper.ErrInvalidUsername):
+			viewsData.Description = "Invalid username."
+		default:
+			viewsData.Description = errorDescription(err)
+		}
+		if len(viewsData.Description) == 0 {
+			http.Redirect(w, r, viewsData.URL, http.StatusFound)
+			return
+		}
+		views.Embed(viewsData, w)
+		return
+	}
+
+	viewsData.Title = "@" + profile.Username
+	if len(profile.FullName) > 0 {
+		viewsData.Title = profile.FullName + " (@" + profile.Username + ")"
+	}
+	if profile.IsVerified {
+		viewsData.Title += " ☑️"
+	}
+	if !modes.gallery {
+		viewsData.Description = profile.Biography
+		if len(viewsData.Description) > 255 {
+			viewsData.Description = utils.Substr(viewsData.Description, 0, 250) + "..."
+		}
+		if len(viewsData.Description) > 0 {
+			viewsData.Description += "\n\n"
+		}
+		viewsData.Description += profileStats(profile)
+	}
+
+	viewsData.Card = "summary"
+	if modes.text {
+		views.Embed(viewsData, w)
+		return
+	}
+	viewsData.ImageURL = "/images/profile/" + profile.Username
+	if modes.gallery && len(profile.Latest) > 1 {
+		viewsData.Card = "summary_large_image"
+		viewsData.ImageURL = "/grid/profile/" + profile.Username
+	}
+	if modes.direct {
+		http.Redirect(w, r, viewsData.ImageURL, http.StatusFound)
+		return
+	}
+	views.Embed(viewsData, w)
+}
+
+// ProfileAvatar redirects to the avatar of a profile
+func ProfileAvatar(w http.ResponseWriter, r *http.Request) {
+	profile, err := scraper.GetProfile(r.Context(), chi.URLParam(r, "username"))
+	if err != nil {
+		http.Error(w, err.Error(), apiErrorStatus(err))
+		return
+	}
+	if ProxyMedia {
+		proxyMediaURL(w, r, profile.AvatarURL)
+		return
+	}
+	http.Redirect(w, r, profile.AvatarURL, http.StatusFound)
+}
+
+// ProfileGrid renders the thumbnails of the latest posts of a profile
+func ProfileGrid(w http.ResponseWriter, r *http.Request) {
+	style, err := parseGridStyle(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	profile, err := scraper.GetProfile(r.Context(), chi.URLParam(r, "username"))
+	if err != nil {
+		http.Error(w, err.Error(), apiErrorStatus(err))
+		return
+	}
+
+	// Keyed by when the profile expires, so the grid of older latest posts isn't served after a scrape
+	key := "profile:" + strings.ToLower(profile.Username) + ":" + strconv.FormatInt(profile.ExpiresAt.UnixNano(), 36)
+	gridFname := gridPath(key + style.variant())
+	if ok, err := serveCachedGrid(w, gridFname); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if ok {
+		return
+	}
+
+	if len(profile.Latest) < 2 {
+		http.Redirect(w, r, "/images/profile/"+profile.Username, http.StatusFound)
+		return
+	}
+	tiles := make([]gridTile, 0, len(profile.Latest))
+	for n, post := range profile.Latest {
+		tiles = append(tiles, gridTile{URL: post.ThumbnailURL, IsVideo: post.IsVideo, Num: n + 1})
+	}
+	serveGrid(w, r, key, gridFname, tiles, style)
+}
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	scraper "instafix/handlers/scraper"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/image/draw"
+)
+
+// newFakeProfile serves a profile whose latest posts are red thumbnails, blue after the first scrape
+func newFakeProfile(t *testing.T) *atomic.Int32 {
+	t.Helper()
+	thumbnail := func(c color.RGBA) []byte {
+		img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+		draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+		var b bytes.Buffer
+		jpeg.Encode(&b, img, nil)
+		return b.Bytes()
+	}
+	red, blue := thumbnail(color.RGBA{255, 0, 0, 255}), thumbnail(color.RGBA{0, 0, 255, 255})
+
+	scrapes := new(atomic.Int32)
+	var srv *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/users/web_profile_info/", func(w http.ResponseWriter, r *http.Request) {
+		color := "red"
+		if scrapes.Add(1) > 1 {
+			color = "blue"
+		}
+		fmt.Fprintf(w, `{"data": {"user": {"username": "gridder", "profile_pic_url": "%[1]s/avatar.jpg",
+			"edge_owner_to_timeline_media": {"count": 2, "edges": [
+				{"node": {"shortcode": "C1", "thumbnail_src": "%[1]s/%[2]s.jpg"}},
+				{"node": {"shortcode": "C2", "thumbnail_src": "%[1]s/%[2]s.jpg", "is_video": true}}
+			]}}}}`, srv.URL, color)
+	})
+	mux.HandleFunc("GET /red.jpg", func(w http.ResponseWriter, r *http.Request) { w.Write(red) })
+	mux.HandleFunc("GET /blue.jpg", func(w http.ResponseWriter, r *http.Request) { w.Write(blue) })
+	srv = httptest.NewServer(mux)
+
+	oldURL, oldCDNHost, oldDB := scraper.InstagramURL, scraper.CDNHost, scraper.DB
+	scraper.InstagramURL, scraper.CDNHost, scraper.DB = srv.URL, "", scraper.NewMemoryCache()
+
+	// Grids are stored relative to the working directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	oldLRU := scraper.LRU
+	if err := scraper.InitLRU(16); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		srv.Close()
+		scraper.DB.Close()
+		scraper.InstagramURL, scraper.CDNHost, scraper.DB = oldURL, oldCDNHost, oldDB
+		scraper.LRU = oldLRU
+		os.Chdir(wd)
+	})
+	return scrapes
+}
+
+func TestProfileGridRefresh(t *testing.T) {
+	scrapes := newFakeProfile(t)
+	r := chi.NewRouter()
+	r.Get("/grid/profile/{username}", ProfileGrid)
+	firstTile := func() color.Color {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/grid/profile/Gridder", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d: %s", w.Code, w.Body)
+		}
+		img, err := jpeg.Decode(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img.At(5, 5)
+	}
+	isRed := func(c color.Color) bool {
+		r, _, b, _ := c.RGBA()
+		return r > b
+	}
+
+	// Served from cache while the profile is fresh
+	for range 2 {
+		if c := firstTile(); !isRed(c) {
+			t.Errorf("got first tile %v, want red", c)
+		}
+	}
+	if n := scrapes.Load(); n != 1 {
+		t.Fatalf("profile scraped %d times, want 1", n)
+	}
+
+	// A new scrape of the profile is a new grid
+	if err := scraper.DB.Delete("profile:gridder"); err != nil {
+		t.Fatal(err)
+	}
+	if c := firstTile(); isRed(c) {
+		t.Errorf("got first tile %v after the profile was scraped again, want blue", c)
+	}
+	if n := scrapes.Load(); n != 2 {
+		t.Errorf("profile scraped %d times, want 2", n)
+	}
+}
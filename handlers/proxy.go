@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/elastic/go-freelru"
+)
+
+var (
+	// ProxyMedia streams /images and /videos through InstaFix instead of redirecting
+	ProxyMedia bool
+
+	// Only these hosts (and their subdomains) can be proxied
+	proxyHosts = []string{"cdninstagram.com", "fbcdn.net"}
+
+	// Response headers passed from upstream to the client
+	proxyHeaders = []string{"Content-Length", "Content-Type", "Content-Range", "Accept-Ranges", "ETag", "Last-Modified"}
+
+	proxyCacheDir string
+	proxyCache    *freelru.SyncedLRU[string, int64] // File name to its size
+
+	// Total size of the cached files, oldest ones are removed above proxyCacheMaxBytes
+	proxyCacheBytes    atomic.Int64
+	proxyCacheMaxBytes int64
+)
+
+const proxyCacheMaxSize = 64 << 20 // Don't cache anything bigger than 64 MiB
+
+var proxyClient = &http.Client{
+	Transport: transport,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if !allowedProxyHost(req.URL.Hostname()) {
+			return errors.New("redirect to disallowed host")
+		}
+		return nil
+	},
+}
+
+func allowedProxyHost(host string) bool {
+	for _, h := range proxyHosts {
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+// InitProxyCache enables the on-disk byte cache of proxied media, up to maxEntries files and maxBytes in total
+func InitProxyCache(dir string, maxEntries int, maxBytes int64) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	lru, err := freelru.NewSynced[string, int64](uint32(maxEntries), func(s string) uint32 {
+		return uint32(xxhash.Sum64String(s))
+	})
+	if err != nil {
+		return err
+	}
+	proxyCacheBytes.Store(0)
+	lru.SetOnEvict(func(key string, size int64) {
+		proxyCacheBytes.Add(-size)
+		os.Remove(key)
+	})
+
+	// Fill LRU with existing files, left over temporary files are removed
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, d := range entries {
+		fname := filepath.Join(dir, d.Name())
+		if strings.HasSuffix(d.Name(), ".tmp") {
+			os.Remove(fname)
+		} else if info, err := d.Info(); err == nil && !d.IsDir() {
+			lru.Add(fname, info.Size())
+			proxyCacheBytes.Add(info.Size())
+		}
+	}
+
+	proxyCacheDir = dir
+	proxyCache = lru
+	proxyCacheMaxBytes = maxBytes
+	trimProxyCache()
+	return nil
+}
+
+// addProxyCache records the cached file fname of size bytes, removing the oldest files above the size limit
+func addProxyCache(fname string, size int64) {
+	if old, ok := proxyCache.Peek(fname); ok {
+		proxyCacheBytes.Add(-old)
+	}
+	proxyCache.Add(fname, size)
+	proxyCacheBytes.Add(size)
+	trimProxyCache()
+}
+
+func trimProxyCache() {
+	for proxyCacheBytes.Load() > proxyCacheMaxBytes {
+		if _, _, ok := proxyCache.RemoveOldest(); !ok {
+			return
+		}
+	}
+}
+
+// proxyMediaURL streams mediaURL to the client, passing Range requests upstream
+func proxyMediaURL(w http.ResponseWriter, r *http.Request, mediaURL string) {
+	u, err := url.Parse(mediaURL)
+	if err != nil || u.Scheme != "https" || !allowedProxyHost(u.Hostname()) {
+		http.Error(w, "media host is not allowed", http.StatusForbidden)
+		return
+	}
+
+	// Serve from disk cache, ServeContent handles Range and If-Range itself
+	var cacheName string
+	if proxyCache != nil {
+		cacheName = filepath.Join(proxyCacheDir, strconv.FormatUint(xxhash.Sum64String(mediaURL), 16))
+		if _, ok := proxyCache.Get(cacheName); ok {
+			if f, err := os.Open(cacheName); err == nil {
+				defer f.Close()
+				if stat, err := f.Stat(); err == nil {
+					http.ServeContent(w, r, path.Base(u.Path), stat.ModTime(), f)
+					return
+				}
+			}
+		}
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, mediaURL, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, h := range []string{"Range", "If-Range"} {
+		if v := r.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	res, err := proxyClient.Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+
+	for _, h := range proxyHeaders {
+		if v := res.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	w.WriteHeader(res.StatusCode)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	// Only complete responses are worth caching
+	if proxyCache == nil || res.StatusCode != http.StatusOK || res.ContentLength > proxyCacheMaxSize {
+		io.Copy(w, res.Body)
+		return
+	}
+	tmp, err := os.CreateTemp(proxyCacheDir, "*.tmp")
+	if err != nil {
+		slog.Error("Failed to create proxy cache file", "err", err)
+		io.Copy(w, res.Body)
+		return
+	}
+	defer os.Remove(tmp.Name()) // No-op after rename
+
+	n, err := io.Copy(io.MultiWriter(w, tmp), io.LimitReader(res.Body, proxyCacheMaxSize+1))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || n > proxyCacheMaxSize || (res.ContentLength >= 0 && n != res.ContentLength) {
+		if n > proxyCacheMaxSize {
+			io.Copy(w, res.Body)
+		}
+		return
+	}
+	if err := os.Rename(tmp.Name(), cacheName); err != nil {
+		slog.Error("Failed to save proxy cache file", "err", err)
+		return
+	}
+	addProxyCache(cacheName, n)
+}
@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func newFakeCDN(t *testing.T, body []byte) (*httptest.Server, *int) {
+	t.Helper()
+	hits := new(int)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*hits++
+		w.Header().Set("Content-Type", "video/mp4")
+		http.ServeContent(w, r, "", time.Unix(1718000000, 0), bytes.NewReader(body))
+	}))
+	oldHosts, oldTransport := proxyHosts, proxyClient.Transport
+	proxyHosts = []string{"127.0.0.1"}
+	proxyClient.Transport = srv.Client().Transport
+	t.Cleanup(func() {
+		srv.Close()
+		proxyHosts, proxyClient.Transport = oldHosts, oldTransport
+	})
+	return srv, hits
+}
+
+func proxyGet(t *testing.T, mediaURL string, header http.Header) *http.Response {
+	t.Helper()
+	return proxyDo(t, http.MethodGet, mediaURL, header)
+}
+
+func proxyDo(t *testing.T, method, mediaURL string, header http.Header) *http.Response {
+	t.Helper()
+	r := httptest.NewRequest(method, "/videos/C/1", nil)
+	r.Header = header
+	w := httptest.NewRecorder()
+	proxyMediaURL(w, r, mediaURL)
+	return w.Result()
+}
+
+func TestProxyMediaRange(t *testing.T) {
+	body := []byte("0123456789abcdef")
+	srv, _ := newFakeCDN(t, body)
+
+	res := proxyGet(t, srv.URL+"/v.mp4", http.Header{"Range": {"bytes=4-7"}})
+	got, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusPartialContent {
+		t.Fatalf("got status %d, want 206", res.StatusCode)
+	}
+	if string(got) != "4567" {
+		t.Errorf("got body %q, want %q", got, "4567")
+	}
+	if cr := res.Header.Get("Content-Range"); cr != "bytes 4-7/16" {
+		t.Errorf("got Content-Range %q", cr)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "video/mp4" {
+		t.Errorf("got Content-Type %q", ct)
+	}
+}
+
+func TestProxyMediaDisallowedHost(t *testing.T) {
+	newFakeCDN(t, nil)
+	for _, mediaURL := range []string{
+		"https://example.com/v.mp4",
+		"https://evilcdninstagram.com/v.mp4",
+		"http://scontent.cdninstagram.com/v.mp4",
+	} {
+		if res := proxyGet(t, mediaURL, http.Header{}); res.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: got status %d, want 403", mediaURL, res.StatusCode)
+		}
+	}
+}
+
+func TestProxyMediaHead(t *testing.T) {
+	body := []byte("0123456789abcdef")
+	srv, _ := newFakeCDN(t, body)
+
+	res := proxyDo(t, http.MethodHead, srv.URL+"/v.mp4", http.Header{})
+	got, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || len(got) > 0 {
+		t.Errorf("got status %d and %d bytes, want 200 without body", res.StatusCode, len(got))
+	}
+	if cl := res.Header.Get("Content-Length"); cl != "16" {
+		t.Errorf("got Content-Length %q, want 16", cl)
+	}
+}
+
+func TestProxyMediaCache(t *testing.T) {
+	body := []byte("0123456789abcdef")
+	srv, hits := newFakeCDN(t, body)
+	if err := InitProxyCache(t.TempDir(), 16, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { proxyCache, proxyCacheDir = nil, "" })
+
+	res := proxyGet(t, srv.URL+"/v.mp4", http.Header{})
+	if got, _ := io.ReadAll(res.Body); !bytes.Equal(got, body) {
+		t.Fatalf("got body %q, want %q", got, body)
+	}
+
+	// Served from disk, Range included
+	res = proxyGet(t, srv.URL+"/v.mp4", http.Header{"Range": {"bytes=10-"}})
+	if got, _ := io.ReadAll(res.Body); string(got) != "abcdef" {
+		t.Errorf("got body %q, want %q", got, "abcdef")
+	}
+	if *hits != 1 {
+		t.Errorf("upstream hit %d times, want 1", *hits)
+	}
+}
+
+func TestProxyMediaCacheSize(t *testing.T) {
+	body := []byte("0123456789abcdef")
+	srv, hits := newFakeCDN(t, body)
+	if err := InitProxyCache(t.TempDir(), 16, 40); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { proxyCache, proxyCacheDir = nil, "" })
+
+	// Only two files of 16 bytes fit in 40, the oldest one goes
+	for _, name := range []string{"a", "b", "c", "a"} {
+		res := proxyGet(t, srv.URL+"/"+name+".mp4", http.Header{})
+		io.ReadAll(res.Body)
+	}
+	if *hits != 4 {
+		t.Errorf("upstream hit %d times, want 4", *hits)
+	}
+	if n := proxyCache.Len(); n != 2 {
+		t.Errorf("got %d cached files, want 2", n)
+	}
+	if size := proxyCacheBytes.Load(); size != 32 {
+		t.Errorf("got %d cached bytes, want 32", size)
+	}
+	entries, err := os.ReadDir(proxyCacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("got %d files on disk, want 2", len(entries))
+	}
+}
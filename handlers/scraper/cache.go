@@ -1,44 +1,74 @@
 package handlers
 
 import (
+	"errors"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/cespare/xxhash/v2"
 	"github.com/elastic/go-freelru"
-	bolt "go.etcd.io/bbolt"
 )
 
-var DB *bolt.DB
+// Cache stores scraped data for a limited time
+type Cache interface {
+	// Get returns ErrCacheMiss if key doesn't exist,
+	// expired keys may still be returned until the backend evicts them
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte, ttl time.Duration) error
+	Delete(key string) error
+	// Iterate calls fn for every key with prefix until fn returns false,
+	// fn must not modify the cache
+	Iterate(prefix string, fn func(key string, value []byte) bool) error
+	// Stats returns the number of keys, per bucket if the backend has them
+	Stats() (map[string]int, error)
+	Close() error
+}
+
+var ErrCacheMiss = errors.New("cache miss")
+
+var DB Cache
 var LRU *freelru.SyncedLRU[string, bool]
+var LRUCapacity int
+
+var (
+	CachePath     = "cache.db" // Used by the bolt backend
+	StaticDir     = "static"   // Grid images, tracked by LRU
+	EvictInterval = 5 * time.Minute
+)
 
 func hashStringXXHASH(s string) uint32 {
 	return uint32(xxhash.Sum64String(s))
 }
 
-func InitDB() {
-	db, err := bolt.Open("cache.db", 0600, nil)
-	if err != nil {
-		panic(err)
+// OpenCache opens a cache backend: "bolt", "memory" or a redis:// URL
+func OpenCache(backend string) (Cache, error) {
+	switch {
+	case backend == "bolt":
+		return NewBoltCache(CachePath)
+	case backend == "memory":
+		return NewMemoryCache(), nil
+	case strings.HasPrefix(backend, "redis://"):
+		return NewRedisCache(backend)
 	}
+	return nil, errors.New("unknown cache backend " + backend)
+}
 
-	// Create buckets
-	err = db.Update(func(tx *bolt.Tx) error {
-		tx.CreateBucketIfNotExists([]byte("data"))
-		tx.CreateBucketIfNotExists([]byte("ttl"))
-		return nil
-	})
+func InitDB(backend string) error {
+	db, err := OpenCache(backend)
 	if err != nil {
-		panic(err)
+		return err
 	}
-
 	DB = db
+	return nil
 }
 
-func InitLRU(maxEntries int) {
+func InitLRU(maxEntries int) error {
 	// Initialize LRU for grid caching
 	lru, err := freelru.NewSynced[string, bool](uint32(maxEntries), hashStringXXHASH)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	lru.SetOnEvict(func(key string, value bool) {
@@ -46,15 +76,20 @@ func InitLRU(maxEntries int) {
 	})
 
 	// Fill LRU with existing files
-	dir, err := os.ReadDir("static")
+	if err := os.MkdirAll(StaticDir, 0755); err != nil {
+		return err
+	}
+	dir, err := os.ReadDir(StaticDir)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	for _, d := range dir {
 		if !d.IsDir() {
-			lru.Add("static/"+d.Name(), true)
+			lru.Add(filepath.Join(StaticDir, d.Name()), true)
 		}
 	}
 
 	LRU = lru
+	LRUCapacity = maxEntries
+	return nil
 }
@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"instafix/utils"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltCache stores values in the data bucket and their expiry in an index:
+//
+//	ttl:    expiry in Unix nanoseconds, big endian (8) | key -> nothing
+//	expiry: key -> expiry in Unix nanoseconds, big endian (8)
+//
+// so eviction can stop at the first unexpired key and Set can drop the old index entry
+type BoltCache struct {
+	db   *bolt.DB
+	stop chan struct{}
+}
+
+// Bumped whenever the index layout changes, see migrate
+const boltIndexVersion = 1
+
+var (
+	dataBucket   = []byte("data")
+	ttlBucket    = []byte("ttl")
+	expiryBucket = []byte("expiry")
+	metaBucket   = []byte("meta")
+)
+
+func NewBoltCache(path string) (*BoltCache, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create buckets
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{dataBucket, ttlBucket, expiryBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return migrateBoltIndex(tx)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	c := &BoltCache{db: db, stop: make(chan struct{})}
+	go c.evictLoop()
+	return c, nil
+}
+
+// migrateBoltIndex rebuilds the ttl index of cache.db files written before it was versioned,
+// their ttl bucket is keyed by the expiry as a decimal string with the key as value
+func migrateBoltIndex(tx *bolt.Tx) error {
+	meta := tx.Bucket(metaBucket)
+	if v := meta.Get([]byte("index_version")); len(v) == 8 && binary.BigEndian.Uint64(v) >= boltIndexVersion {
+		return nil
+	}
+
+	// Keep the latest expiry of every key, older ones are orphans of re-scrapes
+	expiries := make(map[string]int64)
+	err := tx.Bucket(ttlBucket).ForEach(func(k, v []byte) error {
+		n, err := strconv.ParseInt(utils.B2S(k), 10, 64)
+		if err != nil {
+			slog.Warn("Dropping unparsable expire timestamp in cache", "key", string(k))
+			return nil
+		}
+		if n > expiries[string(v)] {
+			expiries[string(v)] = n
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tx.DeleteBucket(ttlBucket); err != nil {
+		return err
+	}
+	if _, err := tx.CreateBucket(ttlBucket); err != nil {
+		return err
+	}
+	// Keys without expiry would never be evicted, give them a full lifetime
+	fallback := time.Now().Add(ExpireTTL).UnixNano()
+	err = tx.Bucket(dataBucket).ForEach(func(k, _ []byte) error {
+		n, ok := expiries[string(k)]
+		if !ok {
+			n = fallback
+		}
+		return putExpiry(tx, k, n)
+	})
+	if err != nil {
+		return err
+	}
+
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, boltIndexVersion)
+	return meta.Put([]byte("index_version"), v)
+}
+
+func ttlKey(expiresAt int64, key []byte) []byte {
+	k := make([]byte, 8+len(key))
+	binary.BigEndian.PutUint64(k, uint64(expiresAt))
+	copy(k[8:], key)
+	return k
+}
+
+// putExpiry indexes key to expire at expiresAt, replacing its previous expiry
+func putExpiry(tx *bolt.Tx, key []byte, expiresAt int64) error {
+	if err := deleteExpiry(tx, key); err != nil {
+		return err
+	}
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(expiresAt))
+	if err := tx.Bucket(expiryBucket).Put(key, v); err != nil {
+		return err
+	}
+	return tx.Bucket(ttlBucket).Put(ttlKey(expiresAt, key), nil)
+}
+
+// deleteExpiry removes key from the index
+func deleteExpiry(tx *bolt.Tx, key []byte) error {
+	expiryB := tx.Bucket(expiryBucket)
+	old := expiryB.Get(key)
+	if len(old) != 8 {
+		return nil
+	}
+	if err := tx.Bucket(ttlBucket).Delete(ttlKey(int64(binary.BigEndian.Uint64(old)), key)); err != nil {
+		return err
+	}
+	return expiryB.Delete(key)
+}
+
+func (c *BoltCache) Get(key string) ([]byte, error) {
+	var value []byte
+	err := c.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(dataBucket).Get(utils.S2B(key)); v != nil {
+			value = bytes.Clone(v)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return nil, ErrCacheMiss
+	}
+	return value, nil
+}
+
+func (c *BoltCache) Set(key string, value []byte, ttl time.Duration) error {
+	return c.db.Batch(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(dataBucket).Put(utils.S2B(key), value); err != nil {
+			return err
+		}
+		return putExpiry(tx, utils.S2B(key), time.Now().Add(ttl).UnixNano())
+	})
+}
+
+func (c *BoltCache) Delete(key string) error {
+	return c.db.Batch(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(dataBucket).Delete(utils.S2B(key)); err != nil {
+			return err
+		}
+		return deleteExpiry(tx, utils.S2B(key))
+	})
+}
+
+func (c *BoltCache) Iterate(prefix string, fn func(key string, value []byte) bool) error {
+	return c.db.View(func(tx *bolt.Tx) error {
+		cur := tx.Bucket(dataBucket).Cursor()
+		p := utils.S2B(prefix)
+		for k, v := cur.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = cur.Next() {
+			if !fn(string(k), v) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+func (c *BoltCache) Stats() (map[string]int, error) {
+	stats := make(map[string]int)
+	err := c.db.View(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{dataBucket, ttlBucket, expiryBucket} {
+			stats[string(name)] = tx.Bucket(name).Stats().KeyN
+		}
+		return nil
+	})
+	return stats, err
+}
+
+func (c *BoltCache) Close() error {
+	close(c.stop)
+	return c.db.Close()
+}
+
+func (c *BoltCache) evictLoop() {
+	ticker := time.NewTicker(EvictInterval)
+	defer ticker.Stop()
+	for {
+		if err := c.evict(time.Now()); err != nil {
+			slog.Error("Failed to evict cache", "err", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// evict removes keys expired before now, the ttl index is sorted by expiry
+// so it only walks over expired keys
+func (c *BoltCache) evict(now time.Time) error {
+	until := make([]byte, 8)
+	binary.BigEndian.PutUint64(until, uint64(now.UnixNano()))
+	var evicted int
+	err := c.db.Batch(func(tx *bolt.Tx) error {
+		// Deleting while iterating makes bolt cursors skip keys, collect them first
+		var expired [][]byte
+		cur := tx.Bucket(ttlBucket).Cursor()
+		for k, _ := cur.First(); k != nil && bytes.Compare(k[:8], until) < 0; k, _ = cur.Next() {
+			expired = append(expired, bytes.Clone(k))
+		}
+		for _, k := range expired {
+			if err := tx.Bucket(ttlBucket).Delete(k); err != nil {
+				return err
+			}
+			if err := tx.Bucket(expiryBucket).Delete(k[8:]); err != nil {
+				return err
+			}
+			if err := tx.Bucket(dataBucket).Delete(k[8:]); err != nil {
+				return err
+			}
+		}
+		evicted = len(expired)
+		return nil
+	})
+	if err == nil {
+		cacheEvictions.WithLabelValues("bolt").Add(float64(evicted))
+	}
+	return err
+}
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+type memoryEntry struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+// MemoryCache keeps everything in process memory, nothing survives a restart
+type MemoryCache struct {
+	mu      sync.RWMutex
+	entries map[string]memoryEntry
+	stop    chan struct{}
+}
+
+func NewMemoryCache() *MemoryCache {
+	c := &MemoryCache{entries: make(map[string]memoryEntry), stop: make(chan struct{})}
+	go c.evictLoop()
+	return c
+}
+
+func (c *MemoryCache) Get(key string) ([]byte, error) {
+	c.mu.RLock()
+	e, ok := c.entries[key]
+	c.mu.RUnlock()
+	if !ok || time.Now().After(e.expiresAt) {
+		return nil, ErrCacheMiss
+	}
+	return e.value, nil
+}
+
+func (c *MemoryCache) Set(key string, value []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	c.entries[key] = memoryEntry{value: value, expiresAt: time.Now().Add(ttl)}
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *MemoryCache) Delete(key string) error {
+	c.mu.Lock()
+	delete(c.entries, key)
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *MemoryCache) Iterate(prefix string, fn func(key string, value []byte) bool) error {
+	now := time.Now()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for k, e := range c.entries {
+		if !strings.HasPrefix(k, prefix) || now.After(e.expiresAt) {
+			continue
+		}
+		if !fn(k, e.value) {
+			break
+		}
+	}
+	return nil
+}
+
+func (c *MemoryCache) Stats() (map[string]int, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return map[string]int{"data": len(c.entries)}, nil
+}
+
+func (c *MemoryCache) Close() error {
+	close(c.stop)
+	return nil
+}
+
+func (c *MemoryCache) evictLoop() {
+	ticker := time.NewTicker(EvictInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.stop:
+			return
+		}
+		now := time.Now()
+		var evicted int
+		c.mu.Lock()
+		for k, e := range c.entries {
+			if now.After(e.expiresAt) {
+				delete(c.entries, k)
+				evicted++
+			}
+		}
+		c.mu.Unlock()
+		cacheEvictions.WithLabelValues("memory").Add(float64(evicted))
+	}
+}
@@ -0,0 +1,257 @@
+package handlers
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every key is prefixed so a shared Redis can be used by other apps too
+const redisKeyPrefix = "instafix:"
+
+// RedisCache talks RESP to Redis (or anything compatible, e.g. Valkey, KeyDB, DragonflyDB)
+// so multiple InstaFix replicas can share one cache
+type RedisCache struct {
+	addr     string
+	password string
+	db       int
+	conns    chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// NewRedisCache connects to redis://[:password@]host:port[/db]
+func NewRedisCache(rawURL string) (*RedisCache, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	c := &RedisCache{addr: u.Host, conns: make(chan *redisConn, 16)}
+	if !strings.Contains(c.addr, ":") {
+		c.addr += ":6379"
+	}
+	if u.User != nil {
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid redis database %q", db)
+		}
+	}
+
+	// Fail early if Redis is not reachable
+	if _, err := c.do("PING"); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *RedisCache) dial() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", c.addr, Timeout)
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{Conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	if c.password != "" {
+		if _, err := rc.do("AUTH", c.password); err != nil {
+			rc.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := rc.do("SELECT", strconv.Itoa(c.db)); err != nil {
+			rc.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// do runs a single command on a pooled connection
+func (c *RedisCache) do(args ...string) (interface{}, error) {
+	var conn *redisConn
+	select {
+	case conn = <-c.conns:
+	default:
+		var err error
+		if conn, err = c.dial(); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := conn.do(args...)
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		// Connection is in an unknown state
+		conn.Close()
+		return nil, err
+	}
+	select {
+	case c.conns <- conn:
+	default:
+		conn.Close()
+	}
+	return reply, err
+}
+
+func (rc *redisConn) do(args ...string) (interface{}, error) {
+	rc.SetDeadline(time.Now().Add(Timeout))
+	rc.w.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		rc.w.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	if err := rc.w.Flush(); err != nil {
+		return nil, err
+	}
+	return readRESP(rc.r)
+}
+
+// readRESP reads one reply, bulk strings are []byte and arrays are []interface{}
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis: malformed reply")
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		arr := make([]interface{}, n)
+		for i := range arr {
+			if arr[i], err = readRESP(r); err != nil {
+				return nil, err
+			}
+		}
+		return arr, nil
+	}
+	return nil, errors.New("redis: unknown reply type")
+}
+
+func (c *RedisCache) Get(key string) ([]byte, error) {
+	reply, err := c.do("GET", redisKeyPrefix+key)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+	return value, nil
+}
+
+func (c *RedisCache) Set(key string, value []byte, ttl time.Duration) error {
+	_, err := c.do("SET", redisKeyPrefix+key, string(value), "PX", strconv.FormatInt(max(1, ttl.Milliseconds()), 10))
+	return err
+}
+
+func (c *RedisCache) Delete(key string) error {
+	_, err := c.do("DEL", redisKeyPrefix+key)
+	return err
+}
+
+func (c *RedisCache) Iterate(prefix string, fn func(key string, value []byte) bool) error {
+	cursor := "0"
+	for {
+		reply, err := c.do("SCAN", cursor, "MATCH", redisKeyPrefix+prefix+"*", "COUNT", "100")
+		if err != nil {
+			return err
+		}
+		arr, ok := reply.([]interface{})
+		if !ok || len(arr) != 2 {
+			return errors.New("redis: malformed SCAN reply")
+		}
+		next, _ := arr[0].([]byte)
+		keys, _ := arr[1].([]interface{})
+		for _, k := range keys {
+			key, _ := k.([]byte)
+			value, err := c.Get(strings.TrimPrefix(string(key), redisKeyPrefix))
+			if errors.Is(err, ErrCacheMiss) {
+				continue // Expired while scanning
+			} else if err != nil {
+				return err
+			}
+			if !fn(strings.TrimPrefix(string(key), redisKeyPrefix), value) {
+				return nil
+			}
+		}
+		cursor = string(next)
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+// Stats counts keys with SCAN, DBSIZE would include keys of other apps
+func (c *RedisCache) Stats() (map[string]int, error) {
+	var n int
+	cursor := "0"
+	for {
+		reply, err := c.do("SCAN", cursor, "MATCH", redisKeyPrefix+"*", "COUNT", "1000")
+		if err != nil {
+			return nil, err
+		}
+		arr, ok := reply.([]interface{})
+		if !ok || len(arr) != 2 {
+			return nil, errors.New("redis: malformed SCAN reply")
+		}
+		keys, _ := arr[1].([]interface{})
+		n += len(keys)
+		next, _ := arr[0].([]byte)
+		if cursor = string(next); cursor == "0" {
+			return map[string]int{"data": n}, nil
+		}
+	}
+}
+
+func (c *RedisCache) Close() error {
+	for {
+		select {
+		case conn := <-c.conns:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
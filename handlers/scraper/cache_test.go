@@ -0,0 +1,245 @@
+package handlers
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// newFakeRedis serves the subset of RESP used by RedisCache, requiring password
+func newFakeRedis(t *testing.T, password string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	var mu sync.Mutex
+	type entry struct {
+		value     string
+		expiresAt time.Time
+	}
+	data := map[string]entry{}
+	get := func(key string) (string, bool) {
+		e, ok := data[key]
+		if !ok || time.Now().After(e.expiresAt) {
+			return "", false
+		}
+		return e.value, true
+	}
+	bulk := func(s string) string { return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n" }
+
+	handle := func(conn net.Conn) {
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		authed := password == ""
+		for {
+			reply, err := readRESP(r)
+			if err != nil {
+				return
+			}
+			var args []string
+			for _, arg := range reply.([]interface{}) {
+				args = append(args, string(arg.([]byte)))
+			}
+
+			mu.Lock()
+			var out string
+			switch cmd := strings.ToUpper(args[0]); {
+			case cmd == "AUTH":
+				authed = args[1] == password
+				out = "+OK\r\n"
+				if !authed {
+					out = "-WRONGPASS invalid password\r\n"
+				}
+			case !authed:
+				out = "-NOAUTH Authentication required.\r\n"
+			case cmd == "PING":
+				out = "+PONG\r\n"
+			case cmd == "SELECT":
+				out = "+OK\r\n"
+			case cmd == "GET":
+				out = "$-1\r\n"
+				if v, ok := get(args[1]); ok {
+					out = bulk(v)
+				}
+			case cmd == "SET":
+				ms, _ := strconv.Atoi(args[4])
+				data[args[1]] = entry{args[2], time.Now().Add(time.Duration(ms) * time.Millisecond)}
+				out = "+OK\r\n"
+			case cmd == "DEL":
+				delete(data, args[1])
+				out = ":1\r\n"
+			case cmd == "SCAN":
+				// Everything in one page
+				prefix := strings.TrimSuffix(args[3], "*")
+				var keys []string
+				for k := range data {
+					if _, ok := get(k); ok && strings.HasPrefix(k, prefix) {
+						keys = append(keys, bulk(k))
+					}
+				}
+				out = "*2\r\n" + bulk("0") + "*" + strconv.Itoa(len(keys)) + "\r\n" + strings.Join(keys, "")
+			default:
+				out = "-ERR unknown command\r\n"
+			}
+			mu.Unlock()
+			conn.Write([]byte(out))
+		}
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestCacheBackends(t *testing.T) {
+	backends := map[string]func(t *testing.T) (Cache, error){
+		"bolt": func(t *testing.T) (Cache, error) {
+			return NewBoltCache(filepath.Join(t.TempDir(), "cache.db"))
+		},
+		"memory": func(t *testing.T) (Cache, error) {
+			return NewMemoryCache(), nil
+		},
+		"redis": func(t *testing.T) (Cache, error) {
+			return NewRedisCache("redis://:secret@" + newFakeRedis(t, "secret") + "/1")
+		},
+	}
+
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			c, err := open(t)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			if _, err := c.Get("C1"); !errors.Is(err, ErrCacheMiss) {
+				t.Fatalf("Get of missing key: got %v, want ErrCacheMiss", err)
+			}
+			for _, key := range []string{"C1", "C2", "negative:C1"} {
+				if err := c.Set(key, []byte("v"+key), time.Hour); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if v, err := c.Get("C1"); err != nil || string(v) != "vC1" {
+				t.Errorf("Get: got %q, %v", v, err)
+			}
+
+			var keys []string
+			err = c.Iterate("negative:", func(key string, value []byte) bool {
+				keys = append(keys, key+"="+string(value))
+				return true
+			})
+			if err != nil || len(keys) != 1 || keys[0] != "negative:C1=vnegative:C1" {
+				t.Errorf("Iterate: got %v, %v", keys, err)
+			}
+
+			if err := c.Delete("C1"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := c.Get("C1"); !errors.Is(err, ErrCacheMiss) {
+				t.Errorf("Get after Delete: got %v, want ErrCacheMiss", err)
+			}
+		})
+	}
+}
+
+func TestRedisCacheWrongPassword(t *testing.T) {
+	addr := newFakeRedis(t, "secret")
+	if _, err := NewRedisCache("redis://:wrong@" + addr); err == nil {
+		t.Fatal("expected an error with a wrong password")
+	}
+}
+
+func TestBoltCacheEvict(t *testing.T) {
+	c, err := NewBoltCache(filepath.Join(t.TempDir(), "cache.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Same expiry must not overwrite each other
+	for _, key := range []string{"C1", "C2", "C3"} {
+		c.Set(key, []byte("v"), time.Hour)
+	}
+	c.db.Update(func(tx *bolt.Tx) error {
+		exp := time.Now().Add(time.Minute).UnixNano()
+		putExpiry(tx, []byte("C1"), exp)
+		putExpiry(tx, []byte("C2"), exp)
+		return nil
+	})
+	// Re-scraped, the old expiry must not evict it
+	c.Set("C1", []byte("v2"), 2*time.Hour)
+
+	if err := c.evict(time.Now().Add(90 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]bool{"C1": true, "C2": false, "C3": false} {
+		if _, err := c.Get(key); (err == nil) != want {
+			t.Errorf("%s: got err %v, want present %v", key, err, want)
+		}
+	}
+	c.db.View(func(tx *bolt.Tx) error {
+		if n := tx.Bucket(ttlBucket).Stats().KeyN; n != 1 {
+			t.Errorf("got %d ttl keys, want 1", n)
+		}
+		if n := tx.Bucket(expiryBucket).Stats().KeyN; n != 1 {
+			t.Errorf("got %d expiry keys, want 1", n)
+		}
+		return nil
+	})
+}
+
+func TestBoltCacheMigrate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	past := strconv.FormatInt(time.Now().Add(-time.Hour).UnixNano(), 10)
+	older := strconv.FormatInt(time.Now().Add(-2*time.Hour).UnixNano(), 10)
+	future := strconv.FormatInt(time.Now().Add(time.Hour).UnixNano(), 10)
+	db.Update(func(tx *bolt.Tx) error {
+		data, _ := tx.CreateBucket([]byte("data"))
+		ttl, _ := tx.CreateBucket([]byte("ttl"))
+		data.Put([]byte("CExpired"), []byte("v"))
+		data.Put([]byte("CRescraped"), []byte("v"))
+		data.Put([]byte("COrphan"), []byte("v"))
+		ttl.Put([]byte(past), []byte("CExpired"))
+		ttl.Put([]byte(older), []byte("CRescraped"))
+		ttl.Put([]byte(future), []byte("CRescraped"))
+		return nil
+	})
+	db.Close()
+
+	c, err := NewBoltCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.evict(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]bool{"CExpired": false, "CRescraped": true, "COrphan": true} {
+		if _, err := c.Get(key); (err == nil) != want {
+			t.Errorf("%s: got err %v, want present %v", key, err, want)
+		}
+	}
+}
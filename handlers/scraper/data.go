@@ -2,8 +2,10 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	_ "embed"
 	"errors"
+	"fmt"
 	"instafix/utils"
 	"io"
 	"log/slog"
@@ -14,24 +16,25 @@ import (
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
-	"github.com/kelindar/binary"
 	"github.com/klauspost/compress/gzhttp"
 	"github.com/klauspost/compress/zstd"
-	"github.com/tdewolff/parse/v2"
-	"github.com/tdewolff/parse/v2/js"
 	"github.com/tidwall/gjson"
-	bolt "go.etcd.io/bbolt"
 	"golang.org/x/net/html"
-	"golang.org/x/sync/singleflight"
 )
 
 var (
 	RemoteScraperAddr string
-	ErrNotFound       = errors.New("post not found")
-	timeout           = 5 * time.Second
+	InstagramURL      = "https://www.instagram.com"
+	ErrVideoBlocked   = errors.New("video is blocked in embed")
+	ErrInvalidPostID  = errors.New("postID is not a valid Instagram post ID")
+	Timeout           = 5 * time.Second
+	StaleTTL          = 24 * time.Hour
+	ExpireTTL         = 7 * 24 * time.Hour
+	CDNHost           = "scontent.cdninstagram.com" // Media URLs are rewritten to this host, empty to keep them
+	cdnRefreshMargin  = time.Hour
 	transport         http.RoundTripper
-	transportNoProxy  *http.Transport
-	sflightScraper    singleflight.Group
+	transportNoProxy  http.RoundTripper
+	sflightScraper    utils.FlightGroup
 	remoteZSTDReader  *zstd.Decoder
 )
 
@@ -39,22 +42,44 @@ var (
 var zstdDict []byte
 
 type Media struct {
-	TypeName string
-	URL      string
+	TypeName     string
+	URL          string
+	ThumbnailURL string // Poster frame of videos
+	Width        int
+	Height       int
+}
+
+// IsImage reports whether m is shown as an image, story videos included
+func (m Media) IsImage() bool {
+	return strings.Contains(m.TypeName, "Image") || strings.Contains(m.TypeName, "StoryVideo")
 }
 
 type InstaData struct {
-	PostID   string
-	Username string
-	Caption  string
-	Medias   []Media
+	PostID     string
+	Username   string
+	FullName   string
+	IsVerified bool
+	Caption    string
+	Location   string
+	Timestamp  int64 // Unix seconds, taken_at_timestamp
+	Likes      int64
+	Comments   int64
+	Views      int64
+	Medias     []Media
+	CoverURL   string // Highlights only
+
+	// Cache entry times, stored in the cache entry header
+	StaleAt      time.Time `binary:"-" json:"-"` // Refreshed in the background after this
+	ExpiresAt    time.Time `binary:"-" json:"-"` // Evicted from cache after this
+	CDNExpiresAt time.Time `binary:"-" json:"-"` // Earliest expiry of the media URLs
 }
 
 func init() {
 	var err error
 	transport = gzhttp.Transport(http.DefaultTransport, gzhttp.TransportAlwaysDecompress(true))
-	transportNoProxy = http.DefaultTransport.(*http.Transport).Clone()
-	transportNoProxy.Proxy = nil // Skip any proxy
+	noProxy := http.DefaultTransport.(*http.Transport).Clone()
+	noProxy.Proxy = nil // Skip any proxy
+	transportNoProxy = noProxy
 
 	remoteZSTDReader, err = zstd.NewReader(nil, zstd.WithDecoderLowmem(true), zstd.WithDecoderDicts(zstdDict))
 	if err != nil {
@@ -62,77 +87,200 @@ func init() {
 	}
 }
 
-func GetData(postID string) (*InstaData, error) {
-	if len(postID) == 0 || (postID[0] != 'C' && postID[0] != 'D' && postID[0] != 'B') {
-		return nil, errors.New("postID is not a valid Instagram post ID")
+func GetData(ctx context.Context, postID string) (*InstaData, error) {
+	if !validPostID(postID) {
+		return nil, ErrInvalidPostID
 	}
 
 	i := &InstaData{PostID: postID}
-	err := DB.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("data"))
-		if b == nil {
-			return nil
-		}
-		v := b.Get([]byte(postID))
-		if v == nil {
-			return nil
-		}
-		err := binary.Unmarshal(v, i)
-		if err != nil {
-			return err
-		}
-		slog.Debug("Data parsed from cache", "postID", postID)
-		return nil
-	})
-	if err != nil {
+	v, err := DB.Get(postID)
+	if err != nil && !errors.Is(err, ErrCacheMiss) {
 		return nil, err
 	}
+	if err == nil {
+		if err := decodeInstaData(v, i); err != nil {
+			// Written by a newer InstaFix or corrupted, scrape it again
+			slog.Warn("Failed to decode cached data", "postID", postID, "err", err)
+			*i = InstaData{PostID: postID}
+		} else {
+			slog.Debug("Data parsed from cache", "postID", postID)
+		}
+	}
 
 	// Successfully parsed from cache
 	if len(i.Medias) != 0 {
+		now := time.Now()
+		switch {
+		case !i.CDNExpiresAt.IsZero() && now.After(i.CDNExpiresAt):
+			// Media URLs are already dead, wait for new ones unless Instagram failed to give them recently
+			if err := getNegative(postID); err != nil {
+				cacheRequests.WithLabelValues("negative").Inc()
+				return i, nil
+			}
+			cacheRequests.WithLabelValues("cdn_expired").Inc()
+			item, err := scrapeAndCache(ctx, postID)
+			if err != nil {
+				slog.Warn("Failed to refresh expired media URLs", "postID", postID, "err", err)
+				return i, nil
+			}
+			return item, nil
+		case now.After(i.FreshUntil()):
+			// Serve stale data while refreshing in the background, unless the last refresh failed recently
+			cacheRequests.WithLabelValues("stale").Inc()
+			if err := getNegative(postID); err == nil {
+				go refreshStale(postID)
+			}
+		default:
+			cacheRequests.WithLabelValues("hit").Inc()
+		}
 		return i, nil
 	}
 
-	ret, err, _ := sflightScraper.Do(postID, func() (interface{}, error) {
+	// Failed recently, don't bother Instagram again
+	if err := getNegative(postID); err != nil {
+		cacheRequests.WithLabelValues("negative").Inc()
+		return nil, err
+	}
+	cacheRequests.WithLabelValues("miss").Inc()
+	return scrapeAndCache(ctx, postID)
+}
+
+// refreshStale scrapes postID again for GetData, its failures are remembered
+// so requests for the stale data don't all retry it
+func refreshStale(postID string) {
+	_, err := scrapeAndCache(context.Background(), postID)
+	if err == nil {
+		return
+	}
+	slog.Warn("Failed to refresh stale data", "postID", postID, "err", err)
+	// Failed scrapes are already cached by scrapeAndCache, not failures to save them
+	var scrapeErr *ScrapeError
+	if !errors.As(err, &scrapeErr) {
+		putNegative(postID, newScrapeError([]error{err}))
+	}
+}
+
+func validPostID(postID string) bool {
+	if p, ok := platformOf(postID); ok {
+		return p.Valid(postID)
+	}
+	return len(postID) > 0 && (postID[0] == 'C' || postID[0] == 'D' || postID[0] == 'B')
+}
+
+// PostURL returns the URL of postID on Instagram (or the platform it is from)
+func PostURL(postID string) string {
+	if p, ok := platformOf(postID); ok {
+		return p.URL(postID)
+	}
+	return "https://www.instagram.com/p/" + postID + "/"
+}
+
+// Lookup returns the cached data of postID without scraping, ErrCacheMiss if there is none
+func Lookup(postID string) (*InstaData, error) {
+	if !validPostID(postID) {
+		return nil, ErrInvalidPostID
+	}
+	v, err := DB.Get(postID)
+	if err != nil {
+		return nil, err
+	}
+	i := new(InstaData)
+	if err := decodeInstaData(v, i); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+// Refresh scrapes postID again, ignoring cached data and failures
+func Refresh(ctx context.Context, postID string) (*InstaData, error) {
+	if !validPostID(postID) {
+		return nil, ErrInvalidPostID
+	}
+	if err := DB.Delete(negativePrefix + postID); err != nil {
+		return nil, err
+	}
+	return scrapeAndCache(ctx, postID)
+}
+
+// Purge removes postID and its cached failure from cache
+func Purge(postID string) error {
+	if !validPostID(postID) {
+		return ErrInvalidPostID
+	}
+	if err := DB.Delete(postID); err != nil {
+		return err
+	}
+	return DB.Delete(negativePrefix + postID)
+}
+
+// FreshUntil returns when cached data should be refreshed,
+// either the stale time or right before media URLs expire
+func (i *InstaData) FreshUntil() time.Time {
+	if !i.CDNExpiresAt.IsZero() && i.CDNExpiresAt.Add(-cdnRefreshMargin).Before(i.StaleAt) {
+		return i.CDNExpiresAt.Add(-cdnRefreshMargin)
+	}
+	return i.StaleAt
+}
+
+// scrapeAndCache scrapes postID and saves the result to cache, concurrent calls are deduplicated
+func scrapeAndCache(ctx context.Context, postID string) (*InstaData, error) {
+	ret, err, _ := sflightScraper.Do(ctx, postID, func(ctx context.Context) (interface{}, error) {
 		item := new(InstaData)
 		item.PostID = postID
-		if err := item.ScrapeData(); err != nil {
+		if err := item.ScrapeData(ctx); err != nil {
 			slog.Error("Failed to scrape data from Instagram", "postID", item.PostID, "err", err)
+			var scrapeErr *ScrapeError
+			if errors.As(err, &scrapeErr) {
+				putNegative(postID, scrapeErr)
+			}
 			return nil, err
 		}
 
-		// Replace all media urls cdn to scontent.cdninstagram.com
+		// Embed HTML doesn't have dimensions, get them from the images instead
+		item.probeDimensions(ctx)
+
+		// Replace all media urls cdn to CDNHost
 		for n, media := range item.Medias {
-			u, err := url.Parse(media.URL)
+			mediaURL, err := rewriteCDNHost(media.URL)
 			if err != nil {
 				slog.Error("Failed to parse media URL", "postID", item.PostID, "err", err)
 				return false, err
 			}
-			u.Host = "scontent.cdninstagram.com"
-			item.Medias[n].URL = u.String()
+			item.Medias[n].URL = mediaURL
+
+			if len(media.ThumbnailURL) == 0 {
+				continue
+			}
+			thumbnailURL, err := rewriteCDNHost(media.ThumbnailURL)
+			if err != nil {
+				slog.Error("Failed to parse thumbnail URL", "postID", item.PostID, "err", err)
+				return false, err
+			}
+			item.Medias[n].ThumbnailURL = thumbnailURL
+		}
+
+		if len(item.CoverURL) > 0 {
+			coverURL, err := rewriteCDNHost(item.CoverURL)
+			if err != nil {
+				slog.Error("Failed to parse cover URL", "postID", item.PostID, "err", err)
+				return false, err
+			}
+			item.CoverURL = coverURL
 		}
 
-		bb, err := binary.Marshal(item)
+		now := time.Now()
+		item.StaleAt, item.ExpiresAt = now.Add(StaleTTL), now.Add(ExpireTTL)
+		if isStoryID(postID) {
+			item.StaleAt, item.ExpiresAt = item.storyCacheTimes(now)
+		}
+		item.CDNExpiresAt = item.cdnExpiry()
+		bb, err := encodeInstaData(item)
 		if err != nil {
 			slog.Error("Failed to marshal data", "postID", item.PostID, "err", err)
 			return false, err
 		}
 
-		err = DB.Batch(func(tx *bolt.Tx) error {
-			dataBucket := tx.Bucket([]byte("data"))
-			if dataBucket == nil {
-				return nil
-			}
-			dataBucket.Put(utils.S2B(item.PostID), bb)
-
-			ttlBucket := tx.Bucket([]byte("ttl"))
-			if ttlBucket == nil {
-				return nil
-			}
-			expTime := strconv.FormatInt(time.Now().Add(24*time.Hour).UnixNano(), 10)
-			ttlBucket.Put(utils.S2B(expTime), utils.S2B(item.PostID))
-			return nil
-		})
+		err = DB.Set(item.PostID, bb, time.Until(item.ExpiresAt))
 		if err != nil {
 			slog.Error("Failed to save data to cache", "postID", item.PostID, "err", err)
 			return false, err
@@ -145,147 +293,66 @@ func GetData(postID string) (*InstaData, error) {
 	return ret.(*InstaData), nil
 }
 
-func (i *InstaData) ScrapeData() error {
-	// Scrape from remote scraper if available
-	if len(RemoteScraperAddr) > 0 {
-		remoteClient := http.Client{Transport: transportNoProxy, Timeout: timeout}
-		req, err := http.NewRequest("GET", RemoteScraperAddr+"/scrape/"+i.PostID, nil)
+// cdnExpiry returns the earliest expiry of the signed media URLs,
+// Instagram puts it in the oe parameter as hex Unix seconds
+func (i *InstaData) cdnExpiry() time.Time {
+	mediaURLs := []string{i.CoverURL}
+	for _, media := range i.Medias {
+		mediaURLs = append(mediaURLs, media.URL, media.ThumbnailURL)
+	}
+
+	var earliest time.Time
+	for _, mediaURL := range mediaURLs {
+		u, err := url.Parse(mediaURL)
 		if err != nil {
-			return err
-		}
-		req.Header.Set("Accept-Encoding", "zstd.dict")
-		res, err := remoteClient.Do(req)
-		if err == nil && res != nil {
-			defer res.Body.Close()
-			remoteData, err := io.ReadAll(res.Body)
-			if err == nil && res.StatusCode == 200 {
-				remoteDecomp, err := remoteZSTDReader.DecodeAll(remoteData, nil)
-				if err != nil {
-					return err
-				}
-				if err := binary.Unmarshal(remoteDecomp, i); err == nil {
-					if len(i.Username) > 0 {
-						slog.Info("Data parsed from remote scraper", "postID", i.PostID)
-						return nil
-					}
-				}
-			}
-			slog.Error("Failed to scrape data from remote scraper", "postID", i.PostID, "status", res.StatusCode, "err", err)
+			continue
 		}
+		oe, err := strconv.ParseInt(u.Query().Get("oe"), 16, 64)
 		if err != nil {
-			slog.Error("Failed when trying to scrape data from remote scraper", "postID", i.PostID, "err", err)
+			continue
+		}
+		if exp := time.Unix(oe, 0); earliest.IsZero() || exp.Before(earliest) {
+			earliest = exp
 		}
 	}
+	return earliest
+}
 
-	client := http.Client{Transport: transport, Timeout: timeout}
-	req, err := http.NewRequest("GET", "https://www.instagram.com/p/"+i.PostID+"/embed/captioned/", nil)
+func rewriteCDNHost(mediaURL string) (string, error) {
+	u, err := url.Parse(mediaURL)
 	if err != nil {
-		return err
+		return "", err
 	}
-
-	var body []byte
-	for retries := 0; retries < 3; retries++ {
-		err := func() error {
-			res, err := client.Do(req)
-			if err != nil {
-				return err
-			}
-			defer res.Body.Close()
-			if res.StatusCode != 200 {
-				return errors.New("status code is not 200")
-			}
-
-			body, err = io.ReadAll(res.Body)
-			if err != nil {
-				return err
-			}
-			return nil
-		}()
-		if err == nil {
-			break
-		}
-	}
-
-	var embedData gjson.Result
-	var timeSliceData gjson.Result
-	if len(body) > 0 {
-		var scriptText []byte
-
-		// TimeSliceImpl (very fragile)
-		for _, line := range bytes.Split(body, []byte("\n")) {
-			if bytes.Contains(line, []byte("shortcode_media")) {
-				scriptText = line
-				break
-			}
-		}
-
-		if len(scriptText) > 0 {
-			// Remove <script>
-			findFirstMoreThan := bytes.Index(scriptText, []byte(">"))
-			scriptText = scriptText[findFirstMoreThan+1:]
-
-			lexer := js.NewLexer(parse.NewInputBytes(scriptText))
-			for {
-				tt, text := lexer.Next()
-				if tt == js.ErrorToken || text == nil {
-					break
-				}
-				if tt == js.StringToken && bytes.Contains(text, []byte("shortcode_media")) {
-					// Strip quotes from start and end
-					text = text[1 : len(text)-1]
-					unescapeData := utils.UnescapeJSONString(utils.B2S(text))
-					if !gjson.Valid(unescapeData) {
-						slog.Error("Failed to parse data from TimeSliceImpl", "postID", i.PostID, "err", err)
-						return err
-					}
-					timeSliceData = gjson.Parse(unescapeData).Get("gql_data")
-				}
-			}
-		} else {
-			slog.Warn("Failed to parse data from TimeSliceImpl", "postID", i.PostID, "err", "No script found")
-		}
-
-		// Scrape from embed HTML
-		embedHTML, err := scrapeFromEmbedHTML(body)
-		if err != nil {
-			slog.Warn("Failed to parse data from scrapeFromEmbedHTML", "postID", i.PostID, "err", err)
-		} else {
-			embedData = gjson.Parse(embedHTML)
-		}
+	if len(CDNHost) == 0 {
+		return mediaURL, nil
 	}
+	u.Host = CDNHost
+	return u.String(), nil
+}
 
-	var gqlData gjson.Result
-	videoBlocked := bytes.Contains(body, []byte("WatchOnInstagram"))
-	// Scrape from GraphQL API only if video is blocked or embed data is empty
-	if videoBlocked || len(body) == 0 {
-		gqlValue, err := scrapeFromGQL(i.PostID)
-		if err != nil {
-			slog.Error("Failed to scrape data from scrapeFromGQL", "postID", i.PostID, "err", err)
-		}
-		if gqlValue != nil && !bytes.Contains(gqlValue, []byte("require_login")) {
-			gqlData = gjson.Parse(utils.B2S(gqlValue)).Get("data")
-			slog.Info("Data parsed from GraphQL API", "postID", i.PostID)
-		}
+// ScrapeData fills i by trying every configured Source in order
+func (i *InstaData) ScrapeData(ctx context.Context) error {
+	chain := sourceChain
+	if p, ok := platformOf(i.PostID); ok {
+		chain = p.Sources
 	}
-
-	// If gqlData is blocked, use timeSliceData or embedData
-	if !gqlData.Exists() {
-		if timeSliceData.Exists() {
-			gqlData = timeSliceData
-			slog.Info("Data parsed from TimeSliceImpl", "postID", i.PostID)
-		} else {
-			gqlData = embedData
-			slog.Info("Data parsed from embedHTML", "postID", i.PostID)
-		}
+	ret, err := scrapeChain(withEmbedPage(ctx), chain, i.PostID)
+	if err != nil {
+		return err
 	}
+	*i = *ret
+	return nil
+}
 
+// parseShortcodeMedia fills i from GraphQL-shaped data (GQL, TimeSliceImpl or embedHTML)
+func (i *InstaData) parseShortcodeMedia(gqlData gjson.Result) error {
 	status := gqlData.Get("status").String()
 	item := gqlData.Get("shortcode_media")
 	if !item.Exists() {
 		item = gqlData.Get("xdt_shortcode_media")
 		if !item.Exists() {
 			if status == "fail" {
-				return errors.New("scrapeFromGQL is blocked")
+				return fmt.Errorf("%w: GraphQL status is fail", ErrRateLimited)
 			}
 			return ErrNotFound
 		}
@@ -296,25 +363,40 @@ func (i *InstaData) ScrapeData() error {
 		media = item.Get("edge_sidecar_to_children.edges").Array()
 	}
 
-	// Get username
+	// Get owner
 	i.Username = item.Get("owner.username").String()
+	i.FullName = item.Get("owner.full_name").String()
+	i.IsVerified = item.Get("owner.is_verified").Bool()
 
 	// Get caption
 	i.Caption = strings.TrimSpace(item.Get("edge_media_to_caption.edges.0.node.text").String())
 
+	// Get post metadata
+	i.Location = item.Get("location.name").String()
+	i.Timestamp = item.Get("taken_at_timestamp").Int()
+	i.Likes = item.Get("edge_media_preview_like.count").Int()
+	i.Comments = item.Get("edge_media_to_parent_comment.count").Int()
+	i.Views = item.Get("video_view_count").Int()
+
 	// Get medias
 	i.Medias = make([]Media, 0, len(media))
 	for _, m := range media {
 		if m.Get("node").Exists() {
 			m = m.Get("node")
 		}
+		var thumbnailURL string
 		mediaURL := m.Get("video_url")
-		if !mediaURL.Exists() {
+		if mediaURL.Exists() {
+			thumbnailURL = m.Get("display_url").String()
+		} else {
 			mediaURL = m.Get("display_url")
 		}
 		i.Medias = append(i.Medias, Media{
-			TypeName: m.Get("__typename").String(),
-			URL:      mediaURL.String(),
+			TypeName:     m.Get("__typename").String(),
+			URL:          mediaURL.String(),
+			ThumbnailURL: thumbnailURL,
+			Width:        int(m.Get("dimensions.width").Int()),
+			Height:       int(m.Get("dimensions.height").Int()),
 		})
 	}
 
@@ -397,7 +479,7 @@ func scrapeFromEmbedHTML(embedHTML []byte) (string, error) {
 	}`, nil
 }
 
-func scrapeFromGQL(postID string) ([]byte, error) {
+func scrapeFromGQL(ctx context.Context, postID string) ([]byte, error) {
 	gqlParams := url.Values{
 		"av":                       {"0"},
 		"__d":                      {"www"},
@@ -424,7 +506,7 @@ func scrapeFromGQL(postID string) ([]byte, error) {
 		"server_timestamps":        {"true"},
 		"doc_id":                   {"25531498899829322"},
 	}
-	req, err := http.NewRequest("POST", "https://www.instagram.com/graphql/query/", strings.NewReader(gqlParams.Encode()))
+	req, err := http.NewRequestWithContext(ctx, "POST", InstagramURL+"/graphql/query/", strings.NewReader(gqlParams.Encode()))
 	if err != nil {
 		return nil, err
 	}
@@ -432,7 +514,7 @@ func scrapeFromGQL(postID string) ([]byte, error) {
 		"Accept":                      {"*/*"},
 		"Accept-Language":             {"en-US,en;q=0.9"},
 		"Content-Type":                {"application/x-www-form-urlencoded"},
-		"Origin":                      {"https://www.instagram.com"},
+		"Origin":                      {InstagramURL},
 		"Priority":                    {"u=1, i"},
 		"Sec-Ch-Prefers-Color-Scheme": {"dark"},
 		"Sec-Ch-Ua":                   {`"Google Chrome";v="125", "Chromium";v="125", "Not.A/Brand";v="24"`},
@@ -451,11 +533,14 @@ func scrapeFromGQL(postID string) ([]byte, error) {
 		"X-Ig-App-Id":                 {"936619743392459"},
 	}
 
-	client := http.Client{Transport: transport, Timeout: timeout}
+	client := http.Client{Transport: transport, Timeout: Timeout}
 	res, err := client.Do(req)
-	if err != nil || res == nil {
-		return nil, err
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNetwork, err)
 	}
 	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, StatusError(res.StatusCode)
+	}
 	return io.ReadAll(res.Body)
 }
@@ -0,0 +1,349 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var update = flag.Bool("update", false, "update golden files in testdata/golden")
+
+// scrapeResult is what golden files record for a scrape
+type scrapeResult struct {
+	Data  *InstaData `json:",omitempty"`
+	Error string     `json:",omitempty"`
+}
+
+func checkGolden(t *testing.T, name string, got scrapeResult) {
+	t.Helper()
+	b, err := json.MarshalIndent(got, "", "\t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b = append(b, '\n')
+
+	fname := filepath.Join("testdata", "golden", name+".json")
+	if *update {
+		if err := os.WriteFile(fname, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(fname)
+	if err != nil {
+		t.Fatalf("missing golden file, run go test -update: %v", err)
+	}
+	if !bytes.Equal(b, want) {
+		t.Errorf("scrape result differs from %s\ngot:\n%s\nwant:\n%s", fname, b, want)
+	}
+}
+
+func TestScrapeDataGolden(t *testing.T) {
+	tests := []struct {
+		name   string
+		postID string
+		remote bool
+	}{
+		{name: "single_image", postID: "CImage00001"},
+		{name: "video", postID: "CVideo00001"},
+		{name: "sidecar", postID: "CSidecar001"},
+		{name: "embed_markup", postID: "CMarkup0001"},
+		{name: "login_required", postID: "CLogin00001"},
+		{name: "unavailable", postID: "CUnavail001"},
+		{name: "watch_on_instagram", postID: "CWatch00001"},
+		{name: "watch_on_instagram_gql_blocked", postID: "CWatchBlk01"},
+		{name: "remote_scraper", postID: "CRemote0001", remote: true},
+		{name: "story", postID: StoryID("storyuser", "3158392745896040411")},
+		{name: "story_login_required", postID: StoryID("storyuser", "3158392745896040433")},
+		{name: "highlight", postID: HighlightID("17900000000000001")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeInstagram(t)
+			if tt.remote {
+				f.useRemoteScraper(t)
+			}
+
+			var got scrapeResult
+			item := &InstaData{PostID: tt.postID}
+			if err := item.ScrapeData(context.Background()); err != nil {
+				got.Error = err.Error()
+			} else {
+				got.Data = item
+			}
+			checkGolden(t, tt.name, got)
+
+			if n := f.Hits(tt.postID, "embed.html"); n > 1 {
+				t.Errorf("embed page fetched %d times, want at most 1", n)
+			}
+		})
+	}
+}
+
+func TestSetSources(t *testing.T) {
+	t.Cleanup(func() { SetSources(DefaultSources) })
+
+	if err := SetSources([]string{"gql", "unknown"}); err == nil {
+		t.Error("SetSources accepted an unknown source")
+	}
+	if err := SetSources([]string{" ", ""}); err == nil {
+		t.Error("SetSources accepted an empty chain")
+	}
+
+	// GQL first skips the embed page entirely
+	if err := SetSources([]string{"gql", "timeslice"}); err != nil {
+		t.Fatal(err)
+	}
+	f := newFakeInstagram(t)
+	item := &InstaData{PostID: "CWatch00001"}
+	if err := item.ScrapeData(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.Hits("CWatch00001", "embed.html"); n != 0 {
+		t.Errorf("embed page fetched %d times, want 0", n)
+	}
+	if n := f.Hits("CWatch00001", "gql.json"); n != 1 {
+		t.Errorf("gql fetched %d times, want 1", n)
+	}
+}
+
+func TestFreshUntil(t *testing.T) {
+	item := &InstaData{Medias: []Media{
+		{URL: "https://scontent.cdninstagram.com/v/a.mp4?efg=x&oe=6700A000", ThumbnailURL: "https://scontent.cdninstagram.com/v/a.jpg?oe=67009000"},
+		{URL: "https://scontent.cdninstagram.com/v/b.jpg"},
+	}}
+	cdnExpiresAt := item.cdnExpiry()
+	if want := time.Unix(0x67009000, 0); !cdnExpiresAt.Equal(want) {
+		t.Fatalf("got CDN expiry %v, want %v", cdnExpiresAt, want)
+	}
+
+	// Refreshed before the media URLs die
+	item.CDNExpiresAt = cdnExpiresAt
+	item.StaleAt = cdnExpiresAt.Add(time.Hour)
+	if got, want := item.FreshUntil(), cdnExpiresAt.Add(-cdnRefreshMargin); !got.Equal(want) {
+		t.Errorf("got fresh until %v, want %v", got, want)
+	}
+
+	// Stale time comes first
+	item.StaleAt = cdnExpiresAt.Add(-2 * cdnRefreshMargin)
+	if got := item.FreshUntil(); !got.Equal(item.StaleAt) {
+		t.Errorf("got fresh until %v, want %v", got, item.StaleAt)
+	}
+
+	// No signed URLs at all
+	item.CDNExpiresAt = time.Time{}
+	if got := item.FreshUntil(); !got.Equal(item.StaleAt) {
+		t.Errorf("got fresh until %v, want %v", got, item.StaleAt)
+	}
+}
+
+func TestScrapeErrorKind(t *testing.T) {
+	newFakeInstagram(t)
+	tests := []struct {
+		postID string
+		kind   error
+	}{
+		{postID: "CLogin00001", kind: ErrPrivate},
+		{postID: "CUnavail001", kind: ErrNotFound},
+		{postID: "CDeleted001", kind: ErrNotFound},
+	}
+	for _, tt := range tests {
+		item := &InstaData{PostID: tt.postID}
+		err := item.ScrapeData(context.Background())
+		if !errors.Is(err, tt.kind) {
+			t.Errorf("%s: got %v, want %v", tt.postID, err, tt.kind)
+		}
+		var scrapeErr *ScrapeError
+		if !errors.As(err, &scrapeErr) || scrapeErr.Kind != tt.kind {
+			t.Errorf("%s: got %v, want ScrapeError of kind %v", tt.postID, err, tt.kind)
+		}
+	}
+}
+
+func TestScrapeGQLFallback(t *testing.T) {
+	f := newFakeInstagram(t)
+	tests := []struct {
+		postID string
+		want   int
+	}{
+		{postID: "CUnavail001", want: 0}, // The embed page says it's gone
+		{postID: "CSidecar001", want: 0},
+		{postID: "CWatch00001", want: 1}, // The embed page blocks the video
+		{postID: "CLogin00001", want: 1}, // The embed page is empty
+	}
+	for _, tt := range tests {
+		(&InstaData{PostID: tt.postID}).ScrapeData(context.Background())
+		if n := f.Hits(tt.postID, "gql.json"); n != tt.want {
+			t.Errorf("%s: GraphQL asked %d times, want %d", tt.postID, n, tt.want)
+		}
+	}
+}
+
+func TestScrapeMetrics(t *testing.T) {
+	newFakeInstagram(t)
+	login := scrapesTotal.WithLabelValues("gql", "private")
+	success := scrapesTotal.WithLabelValues("timeslice", "success")
+	loginBefore, successBefore := testutil.ToFloat64(login), testutil.ToFloat64(success)
+
+	(&InstaData{PostID: "CLogin00001"}).ScrapeData(context.Background())
+	(&InstaData{PostID: "CSidecar001"}).ScrapeData(context.Background())
+	if got := testutil.ToFloat64(login) - loginBefore; got != 1 {
+		t.Errorf("got %v private gql scrapes, want 1", got)
+	}
+	if got := testutil.ToFloat64(success) - successBefore; got != 1 {
+		t.Errorf("got %v successful timeslice scrapes, want 1", got)
+	}
+}
+
+// useMemoryCache gives the test its own empty cache
+func useMemoryCache(t *testing.T) {
+	t.Helper()
+	oldDB := DB
+	DB = NewMemoryCache()
+	t.Cleanup(func() {
+		DB.Close()
+		DB = oldDB
+	})
+}
+
+// cacheItem saves item to cache as scrapeAndCache would
+func cacheItem(t *testing.T, item *InstaData) {
+	t.Helper()
+	b, err := encodeInstaData(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := DB.Set(item.PostID, b, time.Until(item.ExpiresAt)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitFor waits for what background refreshes do
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func staleItem(postID string) *InstaData {
+	now := time.Now()
+	return &InstaData{
+		PostID:    postID,
+		Username:  "natgeo",
+		Caption:   "stale",
+		Medias:    []Media{{TypeName: "GraphImage", URL: "https://scontent.cdninstagram.com/stale.jpg", Width: 1080, Height: 1080}},
+		StaleAt:   now.Add(-time.Hour),
+		ExpiresAt: now.Add(time.Hour),
+	}
+}
+
+func TestGetDataStale(t *testing.T) {
+	f := newFakeInstagram(t)
+	useMemoryCache(t)
+	cacheItem(t, staleItem("CImage00001"))
+
+	// Stale data is served right away, the refresh happens in the background
+	item, err := GetData(context.Background(), "CImage00001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Caption != "stale" {
+		t.Errorf("got caption %q, want the stale one", item.Caption)
+	}
+	waitFor(t, "the refresh", func() bool {
+		item, err := Lookup("CImage00001")
+		return err == nil && item.Caption != "stale"
+	})
+	if hits := f.Hits("CImage00001", "embed.html"); hits != 1 {
+		t.Errorf("embed page fetched %d times, want 1", hits)
+	}
+}
+
+func TestGetDataStaleRefreshFails(t *testing.T) {
+	f := newFakeInstagram(t)
+	useMemoryCache(t)
+	cacheItem(t, staleItem("CDeleted001"))
+	scrapes := func() int {
+		return f.Hits("CDeleted001", "embed.html") + f.Hits("CDeleted001", "gql.json")
+	}
+
+	if _, err := GetData(context.Background(), "CDeleted001"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the failure to be cached", func() bool { return getNegative("CDeleted001") != nil })
+	before := scrapes()
+	if before == 0 {
+		t.Fatal("stale data was not refreshed")
+	}
+
+	// The stale data is kept, and not refreshed again while the failure is cached
+	for range 3 {
+		item, err := GetData(context.Background(), "CDeleted001")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item.Caption != "stale" {
+			t.Errorf("got caption %q, want the stale one", item.Caption)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := scrapes(); got != before {
+		t.Errorf("scraped %d more times after the refresh failed, want 0", got-before)
+	}
+	if item, err := Lookup("CDeleted001"); err != nil || item.Caption != "stale" {
+		t.Errorf("stale entry was not kept: %+v, %v", item, err)
+	}
+}
+
+func TestGetDataCDNExpiredNegative(t *testing.T) {
+	f := newFakeInstagram(t)
+	useMemoryCache(t)
+	expired := staleItem("CDeleted001")
+	expired.StaleAt = time.Now().Add(time.Hour)
+	expired.Medias[0].URL += "?oe=6668D200"
+	expired.CDNExpiresAt = expired.cdnExpiry()
+	cacheItem(t, expired)
+	scrapes := func() int {
+		return f.Hits("CDeleted001", "embed.html") + f.Hits("CDeleted001", "gql.json")
+	}
+
+	// Scraped right away for new media URLs, the failure is cached
+	item, err := GetData(context.Background(), "CDeleted001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Caption != "stale" {
+		t.Errorf("got caption %q, want the cached one", item.Caption)
+	}
+	if getNegative("CDeleted001") == nil {
+		t.Fatal("failure was not cached")
+	}
+	before := scrapes()
+
+	// Then not again while the failure is cached
+	negative := cacheRequests.WithLabelValues("negative")
+	negativeBefore := testutil.ToFloat64(negative)
+	for range 3 {
+		if _, err := GetData(context.Background(), "CDeleted001"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := scrapes(); got != before {
+		t.Errorf("scraped %d more times after the failure was cached, want 0", got-before)
+	}
+	if got := testutil.ToFloat64(negative) - negativeBefore; got != 3 {
+		t.Errorf("got %v negative cache hits, want 3", got)
+	}
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+
+	_ "golang.org/x/image/webp"
+)
+
+// Image headers are at the start of the file, no need to download everything
+const probeBytes = 64 << 10
+
+// ProbeTransport fetches the image headers, nil for the transport of scrapes.
+// Tests replace it so probing never reaches the CDN.
+var ProbeTransport http.RoundTripper
+
+// probeDimensions fills missing media dimensions from the image headers
+func (i *InstaData) probeDimensions(ctx context.Context) {
+	var wg sync.WaitGroup
+	for n := range i.Medias {
+		m := &i.Medias[n]
+		if m.Width > 0 && m.Height > 0 {
+			continue
+		}
+		// Videos are probed from their poster
+		imageURL := m.ThumbnailURL
+		if m.IsImage() {
+			imageURL = m.URL
+		}
+		if len(imageURL) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			width, height, err := probeImageSize(ctx, imageURL)
+			if err != nil {
+				slog.Warn("Failed to probe image dimensions", "postID", i.PostID, "err", err)
+				return
+			}
+			m.Width, m.Height = width, height
+		}()
+	}
+	wg.Wait()
+}
+
+func probeImageSize(ctx context.Context, imageURL string) (int, int, error) {
+	client := http.Client{Transport: transport, Timeout: Timeout}
+	if ProbeTransport != nil {
+		client.Transport = ProbeTransport
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, imageURL, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("Range", "bytes=0-"+strconv.Itoa(probeBytes-1))
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusPartialContent {
+		return 0, 0, errors.New("status code is not 200 or 206")
+	}
+
+	config, _, err := image.DecodeConfig(io.LimitReader(res.Body, probeBytes))
+	if err != nil {
+		return 0, 0, err
+	}
+	return config.Width, config.Height, nil
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProbeDimensions(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 640, 800))); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") == "" {
+			t.Error("probe request has no Range header")
+		}
+		w.Write(buf.Bytes())
+	}))
+	defer srv.Close()
+
+	item := &InstaData{Medias: []Media{
+		{TypeName: "GraphImage", URL: srv.URL},
+		{TypeName: "GraphImage", URL: srv.URL, Width: 1080, Height: 1350},
+		{TypeName: "GraphVideo", URL: srv.URL},
+		{TypeName: "StoryVideo", URL: srv.URL},
+	}}
+	item.probeDimensions(context.Background())
+
+	want := []Media{
+		{TypeName: "GraphImage", URL: srv.URL, Width: 640, Height: 800},
+		{TypeName: "GraphImage", URL: srv.URL, Width: 1080, Height: 1350},
+		{TypeName: "GraphVideo", URL: srv.URL},
+		{TypeName: "StoryVideo", URL: srv.URL, Width: 640, Height: 800},
+	}
+	for n := range want {
+		if item.Medias[n] != want[n] {
+			t.Errorf("media %d: got %+v, want %+v", n, item.Medias[n], want[n])
+		}
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestProbeTransport(t *testing.T) {
+	var probed []string
+	ProbeTransport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		probed = append(probed, r.URL.String())
+		return nil, errors.New("no network in tests")
+	})
+	defer func() { ProbeTransport = nil }()
+
+	item := &InstaData{Medias: []Media{{TypeName: "GraphImage", URL: "https://scontent.cdninstagram.com/a.jpg"}}}
+	item.probeDimensions(context.Background())
+	if len(probed) != 1 || probed[0] != item.Medias[0].URL {
+		t.Errorf("got probes of %q, want %q", probed, item.Medias[0].URL)
+	}
+	if m := item.Medias[0]; m.Width != 0 || m.Height != 0 {
+		t.Errorf("got %dx%d, want no dimensions", m.Width, m.Height)
+	}
+}
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	kbinary "github.com/kelindar/binary"
+)
+
+// Cached InstaData is prefixed with a header, bump encodingVersion whenever
+// InstaData or Media fields change or the header layout changes.
+// The magic byte can't be the first byte of an unversioned entry,
+// which always starts with the uvarint length of a short PostID.
+//
+// Times are Unix nanoseconds, big endian.
+//
+//	magic (1) | version (1) | ExpiresAt (8) | StaleAt (8) | CDNExpiresAt (8) | InstaData
+const (
+	encodingMagic   byte = 0xF1
+	encodingVersion byte = 1
+	headerLen            = 26
+)
+
+var ErrUnsupportedVersion = errors.New("unsupported cache encoding version")
+
+// Version 0 has no header, it was written by InstaFix before entries were versioned
+// and InstaFix-remote-scraper still sends it.
+// Freeze the current InstaData here as a new instaDataVn before changing it.
+type mediaV0 struct {
+	TypeName string
+	URL      string
+}
+
+type instaDataV0 struct {
+	PostID   string
+	Username string
+	Caption  string
+	Medias   []mediaV0
+}
+
+func encodeInstaData(i *InstaData) ([]byte, error) {
+	b, err := kbinary.Marshal(i)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, headerLen, headerLen+len(b))
+	header[0] = encodingMagic
+	header[1] = encodingVersion
+	binary.BigEndian.PutUint64(header[2:], uint64(unixNano(i.ExpiresAt)))
+	binary.BigEndian.PutUint64(header[10:], uint64(unixNano(i.StaleAt)))
+	binary.BigEndian.PutUint64(header[18:], uint64(unixNano(i.CDNExpiresAt)))
+	return append(header, b...), nil
+}
+
+// decodeInstaData decodes any version written by encodeInstaData, version 0 has no
+// StaleAt so it is refreshed (and written in the current version) on its next read
+func decodeInstaData(b []byte, i *InstaData) error {
+	if len(b) > 0 && b[0] != encodingMagic {
+		return decodeV0(b, i)
+	}
+	if len(b) < headerLen || b[1] != encodingVersion {
+		return ErrUnsupportedVersion
+	}
+	if err := kbinary.Unmarshal(b[headerLen:], i); err != nil {
+		return err
+	}
+	i.ExpiresAt = fromUnixNano(binary.BigEndian.Uint64(b[2:]))
+	i.StaleAt = fromUnixNano(binary.BigEndian.Uint64(b[10:]))
+	i.CDNExpiresAt = fromUnixNano(binary.BigEndian.Uint64(b[18:]))
+	return nil
+}
+
+// decodeV0 decodes an unversioned entry or remote scraper payload
+func decodeV0(b []byte, i *InstaData) error {
+	var v0 instaDataV0
+	if err := kbinary.Unmarshal(b, &v0); err != nil {
+		return err
+	}
+	*i = InstaData{PostID: v0.PostID, Username: v0.Username, Caption: v0.Caption}
+	for _, m := range v0.Medias {
+		i.Medias = append(i.Medias, Media{TypeName: m.TypeName, URL: m.URL})
+	}
+	// Not stored in version 0, media URLs still tell when they die
+	i.CDNExpiresAt = i.cdnExpiry()
+	return nil
+}
+
+// Zero time is stored as 0 so it survives the round trip
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(n uint64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(n))
+}
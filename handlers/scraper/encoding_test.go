@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestInstaDataEncoding(t *testing.T) {
+	want := &InstaData{
+		PostID:    "CImage00001",
+		Username:  "natgeo",
+		Caption:   "caption",
+		Timestamp: 1718000000,
+		Likes:     1234,
+		Medias:    []Media{{TypeName: "GraphImage", URL: "https://scontent.cdninstagram.com/a.jpg"}},
+		ExpiresAt: time.Unix(1718086400, 0),
+	}
+	b, err := encodeInstaData(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := new(InstaData)
+	if err := decodeInstaData(b, got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// Written by a newer InstaFix
+	b[1] = encodingVersion + 1
+	if err := decodeInstaData(b, new(InstaData)); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("decoding newer version got %v, want ErrUnsupportedVersion", err)
+	}
+}
+
+// remoteV0Payload returns a version 0 payload as InstaFix-remote-scraper sends it,
+// before zstd, written by hand so it doesn't follow changes to the structs
+func remoteV0Payload(t *testing.T) []byte {
+	t.Helper()
+	b, err := hex.DecodeString("" +
+		"0b" + hex.EncodeToString([]byte("CRemote0001")) +
+		"0a" + hex.EncodeToString([]byte("remoteuser")) +
+		"10" + hex.EncodeToString([]byte("Scraped remotely")) +
+		"01" + // Medias
+		"0a" + hex.EncodeToString([]byte("GraphImage")) +
+		"33" + hex.EncodeToString([]byte("https://scontent.cdninstagram.com/a.jpg?oe=6668D200")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestInstaDataV0Encoding(t *testing.T) {
+	want := &InstaData{
+		PostID: "CRemote0001", Username: "remoteuser", Caption: "Scraped remotely",
+		Medias: []Media{{TypeName: "GraphImage", URL: "https://scontent.cdninstagram.com/a.jpg?oe=6668D200"}},
+		// Version 0 has no StaleAt, it is refreshed on its next read
+		CDNExpiresAt: time.Unix(0x6668D200, 0),
+	}
+	got := new(InstaData)
+	if err := decodeInstaData(remoteV0Payload(t), got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
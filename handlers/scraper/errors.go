@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Kinds of scrape failures, every error returned by a Source should wrap one of these
+var (
+	ErrNotFound        = errors.New("post not found")
+	ErrPrivate         = errors.New("post is private or requires login")
+	ErrRateLimited     = errors.New("rate limited by Instagram")
+	ErrUpstreamChanged = errors.New("unexpected response from Instagram")
+	ErrNetwork         = errors.New("failed to reach Instagram")
+)
+
+// Most relevant kind first, a private post is also "not found" by the embed page
+var errorKinds = []error{ErrPrivate, ErrNotFound, ErrRateLimited, ErrUpstreamChanged, ErrNetwork}
+
+// How long failed scrapes are remembered, keeps retrying crawlers from hammering Instagram
+var negativeTTL = map[error]time.Duration{
+	ErrNotFound:        time.Hour,
+	ErrPrivate:         time.Hour,
+	ErrRateLimited:     5 * time.Minute,
+	ErrUpstreamChanged: 10 * time.Minute,
+	ErrNetwork:         time.Minute,
+}
+
+// ScrapeError is returned when all sources failed, it unwraps to its Kind only
+type ScrapeError struct {
+	Kind error
+	Err  error
+}
+
+func (e *ScrapeError) Error() string {
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+func (e *ScrapeError) Unwrap() error {
+	return e.Kind
+}
+
+var errNegativeCached = errors.New("cached failure")
+
+// newScrapeError picks the most relevant kind out of every source error
+func newScrapeError(errs []error) *ScrapeError {
+	joined := errors.Join(errs...)
+	for _, kind := range errorKinds {
+		for _, err := range errs {
+			if errors.Is(err, kind) {
+				return &ScrapeError{Kind: kind, Err: joined}
+			}
+		}
+	}
+	return &ScrapeError{Kind: ErrUpstreamChanged, Err: joined}
+}
+
+// StatusError maps an unexpected HTTP status from Instagram (or another platform) to an error kind
+func StatusError(statusCode int) error {
+	switch statusCode {
+	case http.StatusNotFound, http.StatusGone:
+		return fmt.Errorf("%w: status code is %d", ErrNotFound, statusCode)
+	case http.StatusTooManyRequests:
+		return fmt.Errorf("%w: status code is %d", ErrRateLimited, statusCode)
+	default:
+		return fmt.Errorf("%w: status code is %d", ErrNetwork, statusCode)
+	}
+}
+
+// Failed scrapes are cached next to the data, under their own key prefix
+const negativePrefix = "negative:"
+
+// getNegative returns the cached failure of postID, if any
+//
+//	kind index (1) | expiry in Unix nanoseconds, big endian (8)
+func getNegative(postID string) error {
+	v, err := DB.Get(negativePrefix + postID)
+	if err != nil || len(v) != 9 || int(v[0]) >= len(errorKinds) {
+		return nil
+	}
+	// Backends may return keys that are expired but not yet evicted
+	if time.Now().UnixNano() > int64(binary.BigEndian.Uint64(v[1:])) {
+		return nil
+	}
+	return &ScrapeError{Kind: errorKinds[v[0]], Err: errNegativeCached}
+}
+
+// putNegative remembers a failed scrape of postID for a short time
+func putNegative(postID string, scrapeErr *ScrapeError) {
+	v := make([]byte, 9)
+	for n, kind := range errorKinds {
+		if kind == scrapeErr.Kind {
+			v[0] = byte(n)
+		}
+	}
+	ttl := negativeTTL[scrapeErr.Kind]
+	binary.BigEndian.PutUint64(v[1:], uint64(time.Now().Add(ttl).UnixNano()))
+	if err := DB.Set(negativePrefix+postID, v, ttl); err != nil {
+		slog.Error("Failed to save failed scrape to cache", "postID", postID, "err", err)
+	}
+}
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Highlights are cached as highlight:{id}, the same ID Instagram uses for their reel
+const highlightPrefix = "highlight:"
+
+// Post sources can't read highlights, only these are tried for them
+var highlightChain = []Source{highlightAPISource{}}
+
+// HighlightID returns the cache key and postID of a highlight
+func HighlightID(id string) string {
+	return highlightPrefix + id
+}
+
+// parseHighlightID returns the numeric ID of a postID made by HighlightID
+func parseHighlightID(postID string) (string, bool) {
+	id, ok := strings.CutPrefix(postID, highlightPrefix)
+	if !ok || len(id) == 0 {
+		return "", false
+	}
+	for _, c := range id {
+		if c < '0' || c > '9' {
+			return "", false
+		}
+	}
+	return id, true
+}
+
+// IsHighlightID reports whether postID was made by HighlightID
+func IsHighlightID(postID string) bool {
+	_, ok := parseHighlightID(postID)
+	return ok
+}
+
+func highlightURL(postID string) string {
+	id, _ := parseHighlightID(postID)
+	return "https://www.instagram.com/stories/highlights/" + id + "/"
+}
+
+// highlightAPISource reads a highlight from the reels media API,
+// Caption is the title and every item of the highlight is a media
+type highlightAPISource struct{}
+
+func (highlightAPISource) Name() string { return "highlightapi" }
+
+func (highlightAPISource) Fetch(ctx context.Context, postID string) (*InstaData, error) {
+	id, ok := parseHighlightID(postID)
+	if !ok {
+		return nil, errSourceDisabled
+	}
+
+	data, err := fetchAPI(ctx, "/api/v1/feed/reels_media/?reel_ids="+HighlightID(id))
+	if err != nil {
+		return nil, err
+	}
+	reel := data.Get("reels_media.0")
+	if !reel.Exists() {
+		return nil, ErrNotFound
+	}
+
+	i := &InstaData{
+		PostID:     postID,
+		Username:   reel.Get("user.username").String(),
+		FullName:   reel.Get("user.full_name").String(),
+		IsVerified: reel.Get("user.is_verified").Bool(),
+		Caption:    strings.TrimSpace(reel.Get("title").String()),
+		Timestamp:  reel.Get("created_at").Int(),
+		Medias:     parseMediaVersions(reel.Get("items").Array()),
+		CoverURL:   reel.Get("cover_media.cropped_image_version.url").String(),
+	}
+	if len(i.Username) == 0 || len(i.Medias) == 0 {
+		return nil, fmt.Errorf("%w: highlight has no items", ErrUpstreamChanged)
+	}
+	return i, nil
+}
+
+// Cover returns the cover image of a highlight, the first image when it has none
+func (i *InstaData) Cover() string {
+	if len(i.CoverURL) > 0 || len(i.Medias) == 0 {
+		return i.CoverURL
+	}
+	if len(i.Medias[0].ThumbnailURL) > 0 {
+		return i.Medias[0].ThumbnailURL
+	}
+	return i.Medias[0].URL
+}
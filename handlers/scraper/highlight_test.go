@@ -0,0 +1,21 @@
+package handlers
+
+import "testing"
+
+func TestHighlightCover(t *testing.T) {
+	tests := []struct {
+		name string
+		item InstaData
+		want string
+	}{
+		{name: "cover", item: InstaData{CoverURL: "cover.jpg", Medias: []Media{{URL: "item.jpg"}}}, want: "cover.jpg"},
+		{name: "first image", item: InstaData{Medias: []Media{{URL: "item.jpg"}}}, want: "item.jpg"},
+		{name: "first video", item: InstaData{Medias: []Media{{URL: "item.mp4", ThumbnailURL: "poster.jpg"}}}, want: "poster.jpg"},
+		{name: "empty", item: InstaData{}, want: ""},
+	}
+	for _, tt := range tests {
+		if got := tt.item.Cover(); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "instafix_cache_requests_total",
+		Help: "Post data cache lookups by result (hit, stale, cdn_expired, negative, miss).",
+	}, []string{"result"})
+	cacheEvictions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "instafix_cache_evictions_total",
+		Help: "Expired keys removed from the cache by backend.",
+	}, []string{"backend"})
+	scrapesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "instafix_scrapes_total",
+		Help: "Scrape attempts by source and outcome.",
+	}, []string{"source", "outcome"})
+	scrapeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "instafix_scrape_duration_seconds",
+		Help:    "Scrape latency by source.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"source"})
+)
+
+func init() {
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name:        "instafix_singleflight_deduplicated_total",
+		Help:        "Calls that joined an in-flight call instead of doing the work again.",
+		ConstLabels: prometheus.Labels{"group": "scrape"},
+	}, func() float64 { return float64(sflightScraper.Deduplicated()) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "instafix_grid_cache_entries",
+		Help: "Grid images in the LRU.",
+	}, func() float64 {
+		if LRU == nil {
+			return 0
+		}
+		return float64(LRU.Len())
+	})
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "instafix_grid_cache_evictions_total",
+		Help: "Grid images evicted from the LRU.",
+	}, func() float64 {
+		if LRU == nil {
+			return 0
+		}
+		return float64(LRU.Metrics().Evictions)
+	})
+}
+
+// scrapeOutcome is the outcome label of a scrape attempt
+func scrapeOutcome(err error) string {
+	switch {
+	case err == nil:
+		return "success"
+	case errors.Is(err, ErrVideoBlocked):
+		return "video_blocked"
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return "canceled"
+	case errors.Is(err, ErrPrivate):
+		return "private"
+	case errors.Is(err, ErrNotFound):
+		return "not_found"
+	case errors.Is(err, ErrRateLimited):
+		return "rate_limited"
+	case errors.Is(err, ErrUpstreamChanged):
+		return "upstream_changed"
+	case errors.Is(err, ErrNetwork):
+		return "network"
+	}
+	return "error"
+}
@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+
+	kbinary "github.com/kelindar/binary"
+)
+
+// Profiles are cached as profile:{username}, next to posts
+const profilePrefix = "profile:"
+
+// Cached Profile is prefixed with a header like InstaData, bump profileEncodingVersion whenever Profile changes
+//
+//	magic (1) | version (1) | ExpiresAt (8) | Profile
+const (
+	profileEncodingVersion byte = 1
+	profileHeaderLen            = 10
+)
+
+var (
+	ProfileTTL         = 6 * time.Hour
+	ErrInvalidUsername = errors.New("username is not a valid Instagram username")
+
+	// Latest posts kept of a profile, enough for a 3x3 grid
+	profileLatestPosts = 9
+)
+
+type ProfilePost struct {
+	PostID       string
+	ThumbnailURL string
+	IsVideo      bool
+}
+
+type Profile struct {
+	Username   string
+	FullName   string
+	Biography  string
+	IsVerified bool
+	IsPrivate  bool
+	AvatarURL  string
+	Followers  int64
+	Following  int64
+	Posts      int64
+	Latest     []ProfilePost
+
+	ExpiresAt time.Time `binary:"-" json:"-"` // Scraped again after this
+}
+
+// validUsername reports whether username only has characters Instagram allows
+func validUsername(username string) bool {
+	if len(username) == 0 || len(username) > 30 {
+		return false
+	}
+	for _, c := range username {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// GetProfile returns the public profile of username from cache or Instagram
+func GetProfile(ctx context.Context, username string) (*Profile, error) {
+	if !validUsername(username) {
+		return nil, ErrInvalidUsername
+	}
+	username = strings.ToLower(username)
+	key := profilePrefix + username
+
+	v, err := DB.Get(key)
+	if err != nil && !errors.Is(err, ErrCacheMiss) {
+		return nil, err
+	}
+	if err == nil {
+		p := new(Profile)
+		if err := decodeProfile(v, p); err != nil {
+			slog.Warn("Failed to decode cached profile", "username", username, "err", err)
+		} else if time.Now().Before(p.ExpiresAt) {
+			cacheRequests.WithLabelValues("hit").Inc()
+			return p, nil
+		}
+	}
+
+	// Failed recently, don't bother Instagram again
+	if err := getNegative(key); err != nil {
+		cacheRequests.WithLabelValues("negative").Inc()
+		return nil, err
+	}
+	cacheRequests.WithLabelValues("miss").Inc()
+
+	ret, err, _ := sflightScraper.Do(ctx, key, func(ctx context.Context) (interface{}, error) {
+		start := time.Now()
+		p, err := fetchProfile(ctx, username)
+		scrapeDuration.WithLabelValues("profile").Observe(time.Since(start).Seconds())
+		scrapesTotal.WithLabelValues("profile", scrapeOutcome(err)).Inc()
+		if err != nil && ctx.Err() != nil {
+			return nil, err
+		} else if err != nil {
+			slog.Error("Failed to scrape profile from Instagram", "username", username, "err", err)
+			scrapeErr := newScrapeError([]error{err})
+			putNegative(key, scrapeErr)
+			return nil, scrapeErr
+		}
+
+		if p.AvatarURL, err = rewriteCDNHost(p.AvatarURL); err != nil {
+			return nil, err
+		}
+		for n, post := range p.Latest {
+			if p.Latest[n].ThumbnailURL, err = rewriteCDNHost(post.ThumbnailURL); err != nil {
+				return nil, err
+			}
+		}
+
+		p.ExpiresAt = time.Now().Add(ProfileTTL)
+		bb, err := encodeProfile(p)
+		if err != nil {
+			return nil, err
+		}
+		if err := DB.Set(key, bb, ProfileTTL); err != nil {
+			slog.Error("Failed to save profile to cache", "username", username, "err", err)
+			return nil, err
+		}
+		return p, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret.(*Profile), nil
+}
+
+// fetchProfile scrapes the web profile API, it works without login for public profiles
+func fetchProfile(ctx context.Context, username string) (*Profile, error) {
+	data, err := fetchAPI(ctx, "/api/v1/users/web_profile_info/?username="+url.QueryEscape(username))
+	if err != nil {
+		return nil, err
+	}
+	user := data.Get("data.user")
+	if !user.IsObject() {
+		return nil, ErrNotFound
+	}
+
+	p := &Profile{
+		Username:   user.Get("username").String(),
+		FullName:   user.Get("full_name").String(),
+		Biography:  strings.TrimSpace(user.Get("biography").String()),
+		IsVerified: user.Get("is_verified").Bool(),
+		IsPrivate:  user.Get("is_private").Bool(),
+		AvatarURL:  user.Get("profile_pic_url_hd").String(),
+		Followers:  user.Get("edge_followed_by.count").Int(),
+		Following:  user.Get("edge_follow.count").Int(),
+		Posts:      user.Get("edge_owner_to_timeline_media.count").Int(),
+	}
+	if len(p.AvatarURL) == 0 {
+		p.AvatarURL = user.Get("profile_pic_url").String()
+	}
+	if len(p.Username) == 0 {
+		return nil, fmt.Errorf("%w: profile has no username", ErrUpstreamChanged)
+	}
+	for _, edge := range user.Get("edge_owner_to_timeline_media.edges").Array() {
+		if len(p.Latest) == profileLatestPosts {
+			break
+		}
+		node := edge.Get("node")
+		p.Latest = append(p.Latest, ProfilePost{
+			PostID:       node.Get("shortcode").String(),
+			ThumbnailURL: node.Get("thumbnail_src").String(),
+			IsVideo:      node.Get("is_video").Bool(),
+		})
+	}
+	return p, nil
+}
+
+func encodeProfile(p *Profile) ([]byte, error) {
+	b, err := kbinary.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, profileHeaderLen, profileHeaderLen+len(b))
+	header[0] = encodingMagic
+	header[1] = profileEncodingVersion
+	binary.BigEndian.PutUint64(header[2:], uint64(unixNano(p.ExpiresAt)))
+	return append(header, b...), nil
+}
+
+func decodeProfile(b []byte, p *Profile) error {
+	if len(b) < profileHeaderLen || b[0] != encodingMagic || b[1] != profileEncodingVersion {
+		return ErrUnsupportedVersion
+	}
+	if err := kbinary.Unmarshal(b[profileHeaderLen:], p); err != nil {
+		return err
+	}
+	p.ExpiresAt = fromUnixNano(binary.BigEndian.Uint64(b[2:]))
+	return nil
+}
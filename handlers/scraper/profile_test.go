@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestGetProfile(t *testing.T) {
+	f := newFakeInstagram(t)
+	oldDB := DB
+	DB = NewMemoryCache()
+	t.Cleanup(func() {
+		DB.Close()
+		DB = oldDB
+	})
+
+	for range 2 {
+		p, err := GetProfile(context.Background(), "ProfileUser")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Username != "profileuser" || p.FullName != "Profile User" || !p.IsVerified || p.Biography != "Photos of things" {
+			t.Errorf("got profile %+v", p)
+		}
+		if p.Followers != 12345 || p.Following != 321 || p.Posts != 42 {
+			t.Errorf("got %d followers, %d following, %d posts, want 12345, 321, 42", p.Followers, p.Following, p.Posts)
+		}
+		if len(p.Latest) != 3 || p.Latest[1].PostID != "CVideo00001" || !p.Latest[1].IsVideo {
+			t.Errorf("got latest posts %+v", p.Latest)
+		}
+		if want := "https://" + CDNHost + "/v/t51.2885-19/avatar.jpg?oe=66700000"; p.AvatarURL != want {
+			t.Errorf("got avatar %s, want %s", p.AvatarURL, want)
+		}
+	}
+	if hits := f.Hits("profileuser", "web_profile_info.json"); hits != 1 {
+		t.Errorf("profile was scraped %d times, want 1", hits)
+	}
+
+	for range 2 {
+		if _, err := GetProfile(context.Background(), "nobody"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v, want ErrNotFound", err)
+		}
+	}
+	if hits := f.Hits("nobody", "web_profile_info.json"); hits != 1 {
+		t.Errorf("missing profile was scraped %d times, want 1", hits)
+	}
+
+	if _, err := GetProfile(context.Background(), "../etc"); !errors.Is(err, ErrInvalidUsername) {
+		t.Errorf("got %v, want ErrInvalidUsername", err)
+	}
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"instafix/utils"
+	"log/slog"
+	"net/http"
+	"net/url"
+)
+
+// Share links never change their target, cache them as long as posts
+const sharePrefix = "share:"
+
+var sflightShare utils.FlightGroup
+
+// ResolveShare returns the postID a share link redirects to
+func ResolveShare(ctx context.Context, link utils.Link) (string, error) {
+	if v, err := DB.Get(sharePrefix + link.ID); err == nil {
+		return string(v), nil
+	}
+
+	ret, err, _ := sflightShare.Do(ctx, link.ID, func(ctx context.Context) (interface{}, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, InstagramURL+link.Path, nil)
+		if err != nil {
+			return nil, err
+		}
+		res, err := transport.RoundTrip(req)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrNetwork, err)
+		}
+		res.Body.Close()
+		if res.StatusCode < 300 {
+			// Unknown share links get a page instead of a redirect
+			return nil, fmt.Errorf("%w: share link doesn't redirect, status code is %d", ErrNotFound, res.StatusCode)
+		} else if res.StatusCode >= 400 {
+			return nil, StatusError(res.StatusCode)
+		}
+
+		redirURL, err := url.Parse(res.Header.Get("Location"))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrUpstreamChanged, err)
+		}
+		target, err := utils.MatchLink(redirURL.Path, nil)
+		if err != nil || target.Kind != utils.LinkPost {
+			// Redirected to login page
+			return nil, fmt.Errorf("%w: share link redirects to %s", ErrPrivate, redirURL.Path)
+		}
+
+		if err := DB.Set(sharePrefix+link.ID, []byte(target.ID), ExpireTTL); err != nil {
+			slog.Error("Failed to save share link to cache", "shareID", link.ID, "err", err)
+		}
+		return target.ID, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return ret.(string), nil
+}
@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"instafix/utils"
+	"testing"
+)
+
+func TestResolveShare(t *testing.T) {
+	f := newFakeInstagram(t)
+	f.shares["reel/AbCdEf123"] = "/reel/CSidecar001/?igsh=abc"
+	oldDB := DB
+	DB = NewMemoryCache()
+	t.Cleanup(func() {
+		DB.Close()
+		DB = oldDB
+	})
+
+	link, err := utils.ParseLink("https://www.instagram.com/share/reel/AbCdEf123/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		postID, err := ResolveShare(context.Background(), link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if postID != "CSidecar001" {
+			t.Errorf("got postID %q, want CSidecar001", postID)
+		}
+	}
+	if hits := f.Hits("reel/AbCdEf123", "share"); hits != 1 {
+		t.Errorf("share link was resolved %d times, want 1", hits)
+	}
+
+	link, _ = utils.ParseLink("https://www.instagram.com/share/p/Private123/")
+	if _, err := ResolveShare(context.Background(), link); !errors.Is(err, ErrPrivate) {
+		t.Errorf("got %v, want ErrPrivate", err)
+	}
+
+	f.shares["Unknown123"] = ""
+	link, _ = utils.ParseLink("https://www.instagram.com/share/Unknown123/")
+	if _, err := ResolveShare(context.Background(), link); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v, want ErrNotFound", err)
+	}
+}
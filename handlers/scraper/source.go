@@ -0,0 +1,398 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"instafix/utils"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tdewolff/parse/v2"
+	"github.com/tdewolff/parse/v2/js"
+	"github.com/tidwall/gjson"
+)
+
+// Source is a single way of getting post data from Instagram
+type Source interface {
+	Name() string
+	Fetch(ctx context.Context, postID string) (*InstaData, error)
+}
+
+var (
+	// DefaultSources is the order sources are tried in when none is configured
+	DefaultSources = []string{"remote", "timeslice", "embedhtml", "gql"}
+
+	errSourceDisabled = errors.New("source is disabled")
+	errSourceSkipped  = errors.New("source is not needed for this post")
+
+	registeredSources = map[string]Source{}
+	sourceChain       []Source
+	platforms         []Platform
+)
+
+// Platform is anything scraped into InstaData besides Instagram posts,
+// its postIDs start with Prefix so they never collide with shortcodes in cache
+type Platform struct {
+	Prefix  string
+	Valid   func(postID string) bool
+	URL     func(postID string) string // Where people are sent instead of the embed
+	Sources []Source                   // Tried in order instead of the configured sources
+}
+
+func init() {
+	RegisterSource(remoteSource{})
+	RegisterSource(timeSliceSource{})
+	RegisterSource(embedHTMLSource{})
+	RegisterSource(gqlSource{})
+	if err := SetSources(DefaultSources); err != nil {
+		panic(err)
+	}
+
+	RegisterPlatform(Platform{Prefix: storyPrefix, Valid: isStoryID, URL: storyURL, Sources: storyChain})
+	RegisterPlatform(Platform{Prefix: highlightPrefix, Valid: IsHighlightID, URL: highlightURL, Sources: highlightChain})
+}
+
+// RegisterPlatform makes GetData accept postIDs of p and scrape them from p.Sources
+func RegisterPlatform(p Platform) {
+	platforms = append(platforms, p)
+}
+
+// platformOf returns the platform postID belongs to, false for Instagram posts
+func platformOf(postID string) (Platform, bool) {
+	for _, p := range platforms {
+		if strings.HasPrefix(postID, p.Prefix) {
+			return p, true
+		}
+	}
+	return Platform{}, false
+}
+
+// RegisterSource makes a source available to SetSources by its name
+func RegisterSource(s Source) {
+	registeredSources[s.Name()] = s
+}
+
+// SetSources configures the ordered chain of sources used by ScrapeData
+func SetSources(names []string) error {
+	chain := make([]Source, 0, len(names))
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		s, ok := registeredSources[name]
+		if !ok {
+			return fmt.Errorf("unknown scrape source %q", name)
+		}
+		chain = append(chain, s)
+	}
+	if len(chain) == 0 {
+		return errors.New("at least one scrape source is required")
+	}
+	sourceChain = chain
+	return nil
+}
+
+// scrapeChain tries every source of chain in order and returns the first complete result.
+// Results marked with ErrVideoBlocked are kept as a fallback in case no later source succeeds.
+func scrapeChain(ctx context.Context, chain []Source, postID string) (*InstaData, error) {
+	var fallback *InstaData
+	var errs []error
+	for _, s := range chain {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		item, err := s.Fetch(ctx, postID)
+		if errors.Is(err, errSourceDisabled) || errors.Is(err, errSourceSkipped) {
+			continue
+		}
+		scrapeDuration.WithLabelValues(s.Name()).Observe(time.Since(start).Seconds())
+		scrapesTotal.WithLabelValues(s.Name(), scrapeOutcome(err)).Inc()
+		if err == nil {
+			slog.Info("Data parsed from "+s.Name(), "postID", postID)
+			return item, nil
+		}
+		if errors.Is(err, ErrVideoBlocked) && item != nil && fallback == nil {
+			fallback = item
+		}
+		slog.Warn("Failed to scrape data", "source", s.Name(), "postID", postID, "err", err)
+		errs = append(errs, fmt.Errorf("%s: %w", s.Name(), err))
+	}
+	if fallback != nil {
+		return fallback, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(errs) == 0 {
+		return nil, &ScrapeError{Kind: ErrNotFound, Err: errors.New("no source available")}
+	}
+	return nil, newScrapeError(errs)
+}
+
+type embedPageKey struct{}
+
+// embedPage memoizes the /embed/captioned/ page so sources parsing it share one request
+type embedPage struct {
+	once    sync.Once
+	fetched bool
+	body    []byte
+	err     error
+}
+
+func withEmbedPage(ctx context.Context) context.Context {
+	return context.WithValue(ctx, embedPageKey{}, &embedPage{})
+}
+
+func getEmbedPage(ctx context.Context, postID string) ([]byte, error) {
+	p, ok := ctx.Value(embedPageKey{}).(*embedPage)
+	if !ok {
+		return fetchEmbedPage(ctx, postID)
+	}
+	p.once.Do(func() {
+		p.body, p.err = fetchEmbedPage(ctx, postID)
+		p.fetched = true
+	})
+	return p.body, p.err
+}
+
+// embedPageHasPost reports whether an earlier source got the embed page and the post isn't blocked in it,
+// whatever the embed page says about the post is then the answer
+func embedPageHasPost(ctx context.Context) bool {
+	p, ok := ctx.Value(embedPageKey{}).(*embedPage)
+	return ok && p.fetched && p.err == nil && !bytes.Contains(p.body, []byte("WatchOnInstagram"))
+}
+
+func fetchEmbedPage(ctx context.Context, postID string) ([]byte, error) {
+	client := http.Client{Transport: transport, Timeout: Timeout}
+	req, err := http.NewRequestWithContext(ctx, "GET", InstagramURL+"/p/"+postID+"/embed/captioned/", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var body []byte
+	for retries := 0; retries < 3; retries++ {
+		err = func() error {
+			res, err := client.Do(req)
+			if err != nil {
+				return fmt.Errorf("%w: %w", ErrNetwork, err)
+			}
+			defer res.Body.Close()
+			if res.StatusCode != 200 {
+				return StatusError(res.StatusCode)
+			}
+
+			body, err = io.ReadAll(res.Body)
+			if err != nil {
+				return fmt.Errorf("%w: %w", ErrNetwork, err)
+			}
+			return nil
+		}()
+		// No point in retrying if nobody is waiting anymore
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(body) == 0 {
+		return nil, fmt.Errorf("%w: embed page is empty", ErrUpstreamChanged)
+	}
+	return body, nil
+}
+
+// fetchAPI gets path from the web API Instagram's own site uses, some of it answers without login
+func fetchAPI(ctx context.Context, path string) (gjson.Result, error) {
+	client := http.Client{Transport: transport, Timeout: Timeout}
+	req, err := http.NewRequestWithContext(ctx, "GET", InstagramURL+path, nil)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	req.Header.Set("X-Ig-App-Id", "936619743392459")
+	res, err := client.Do(req)
+	if err != nil {
+		return gjson.Result{}, fmt.Errorf("%w: %w", ErrNetwork, err)
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return gjson.Result{}, fmt.Errorf("%w: status code is %d", ErrPrivate, res.StatusCode)
+	default:
+		return gjson.Result{}, StatusError(res.StatusCode)
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return gjson.Result{}, fmt.Errorf("%w: %w", ErrNetwork, err)
+	}
+
+	data := gjson.ParseBytes(body)
+	if data.Get("require_login").Bool() {
+		return gjson.Result{}, fmt.Errorf("%w: API requires login", ErrPrivate)
+	}
+	return data, nil
+}
+
+// remoteSource scrapes from InstaFix-remote-scraper
+type remoteSource struct{}
+
+func (remoteSource) Name() string { return "remote" }
+
+func (remoteSource) Fetch(ctx context.Context, postID string) (*InstaData, error) {
+	if len(RemoteScraperAddr) == 0 {
+		return nil, errSourceDisabled
+	}
+
+	remoteClient := http.Client{Transport: transportNoProxy, Timeout: Timeout}
+	req, err := http.NewRequestWithContext(ctx, "GET", RemoteScraperAddr+"/scrape/"+postID, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept-Encoding", "zstd.dict")
+	// Newest payload version we can decode, older remote scrapers ignore it and send version 0
+	req.Header.Set("X-InstaFix-Encoding-Version", strconv.Itoa(int(encodingVersion)))
+	res, err := remoteClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNetwork, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, StatusError(res.StatusCode)
+	}
+
+	remoteData, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNetwork, err)
+	}
+	remoteDecomp, err := remoteZSTDReader.DecodeAll(remoteData, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrUpstreamChanged, err)
+	}
+
+	i := new(InstaData)
+	if err := decodeInstaData(remoteDecomp, i); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrUpstreamChanged, err)
+	}
+	i.PostID = postID
+	if len(i.Username) == 0 {
+		return nil, ErrNotFound
+	}
+	return i, nil
+}
+
+// timeSliceSource parses the GraphQL data embedded in the TimeSliceImpl script (very fragile)
+type timeSliceSource struct{}
+
+func (timeSliceSource) Name() string { return "timeslice" }
+
+func (timeSliceSource) Fetch(ctx context.Context, postID string) (*InstaData, error) {
+	body, err := getEmbedPage(ctx, postID)
+	if err != nil {
+		return nil, err
+	}
+
+	var scriptText []byte
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		if bytes.Contains(line, []byte("shortcode_media")) {
+			scriptText = line
+			break
+		}
+	}
+	if len(scriptText) == 0 {
+		return nil, fmt.Errorf("%w: no TimeSliceImpl script found", ErrUpstreamChanged)
+	}
+
+	// Remove <script>
+	findFirstMoreThan := bytes.Index(scriptText, []byte(">"))
+	scriptText = scriptText[findFirstMoreThan+1:]
+
+	var timeSliceData gjson.Result
+	lexer := js.NewLexer(parse.NewInputBytes(scriptText))
+	for {
+		tt, text := lexer.Next()
+		if tt == js.ErrorToken || text == nil {
+			break
+		}
+		if tt == js.StringToken && bytes.Contains(text, []byte("shortcode_media")) {
+			// Strip quotes from start and end
+			text = text[1 : len(text)-1]
+			unescapeData := utils.UnescapeJSONString(utils.B2S(text))
+			if !gjson.Valid(unescapeData) {
+				return nil, fmt.Errorf("%w: invalid JSON in TimeSliceImpl", ErrUpstreamChanged)
+			}
+			timeSliceData = gjson.Parse(unescapeData).Get("gql_data")
+		}
+	}
+	if !timeSliceData.Exists() {
+		return nil, fmt.Errorf("%w: no gql_data in TimeSliceImpl", ErrUpstreamChanged)
+	}
+	return parseEmbedData(postID, body, timeSliceData)
+}
+
+// embedHTMLSource parses the rendered markup of the embed page
+type embedHTMLSource struct{}
+
+func (embedHTMLSource) Name() string { return "embedhtml" }
+
+func (embedHTMLSource) Fetch(ctx context.Context, postID string) (*InstaData, error) {
+	body, err := getEmbedPage(ctx, postID)
+	if err != nil {
+		return nil, err
+	}
+	embedHTML, err := scrapeFromEmbedHTML(body)
+	if err != nil {
+		return nil, err
+	}
+	return parseEmbedData(postID, body, gjson.Parse(embedHTML))
+}
+
+// parseEmbedData parses data taken from the embed page,
+// the result is only a fallback if the page says the video is blocked
+func parseEmbedData(postID string, body []byte, data gjson.Result) (*InstaData, error) {
+	i := &InstaData{PostID: postID}
+	if err := i.parseShortcodeMedia(data); err != nil {
+		return nil, err
+	}
+	if bytes.Contains(body, []byte("WatchOnInstagram")) {
+		return i, ErrVideoBlocked
+	}
+	return i, nil
+}
+
+// gqlSource scrapes from the GraphQL API
+type gqlSource struct{}
+
+func (gqlSource) Name() string { return "gql" }
+
+func (gqlSource) Fetch(ctx context.Context, postID string) (*InstaData, error) {
+	// GraphQL rate limits the hardest, only ask it when the embed page is missing or blocks the video
+	if embedPageHasPost(ctx) {
+		return nil, errSourceSkipped
+	}
+	gqlValue, err := scrapeFromGQL(ctx, postID)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Contains(gqlValue, []byte("require_login")) {
+		return nil, fmt.Errorf("%w: GraphQL requires login", ErrPrivate)
+	}
+
+	gqlData := gjson.Parse(utils.B2S(gqlValue))
+	i := &InstaData{PostID: postID}
+	if err := i.parseShortcodeMedia(gqlData.Get("data")); err != nil {
+		if errors.Is(err, ErrNotFound) && gqlData.Get("status").String() == "fail" {
+			return nil, fmt.Errorf("%w: GraphQL status is fail", ErrRateLimited)
+		}
+		return nil, err
+	}
+	return i, nil
+}
@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// Stories are cached as story:{username}:{mediaID}, they have no shortcode
+const storyPrefix = "story:"
+
+var (
+	StoryStaleTTL = 30 * time.Minute
+	storyLifetime = 24 * time.Hour // Instagram removes stories a day after they are posted
+
+	// Post sources can't read stories, only these are tried for them
+	storyChain = []Source{storyAPISource{}}
+)
+
+// StoryID returns the cache key and postID of a story, usernames are case insensitive
+func StoryID(username, mediaID string) string {
+	return storyPrefix + strings.ToLower(username) + ":" + mediaID
+}
+
+// parseStoryID splits a postID made by StoryID
+func parseStoryID(postID string) (string, string, bool) {
+	rest, ok := strings.CutPrefix(postID, storyPrefix)
+	if !ok {
+		return "", "", false
+	}
+	username, mediaID, ok := strings.Cut(rest, ":")
+	if !ok || !validUsername(username) || len(mediaID) == 0 {
+		return "", "", false
+	}
+	for _, c := range mediaID {
+		if c < '0' || c > '9' {
+			return "", "", false
+		}
+	}
+	return username, mediaID, true
+}
+
+func isStoryID(postID string) bool {
+	_, _, ok := parseStoryID(postID)
+	return ok
+}
+
+func storyURL(postID string) string {
+	username, mediaID, _ := parseStoryID(postID)
+	return "https://www.instagram.com/stories/" + username + "/" + mediaID + "/"
+}
+
+// storyCacheTimes refreshes stories often and drops them when Instagram does
+func (i *InstaData) storyCacheTimes(now time.Time) (time.Time, time.Time) {
+	expiresAt := now.Add(storyLifetime)
+	if i.Timestamp > 0 {
+		expiresAt = time.Unix(i.Timestamp, 0).Add(storyLifetime)
+	}
+	staleAt := now.Add(StoryStaleTTL)
+	if expiresAt.Before(staleAt) {
+		// Already gone from Instagram, keep it just long enough to not scrape it again right away
+		expiresAt = staleAt
+	}
+	return staleAt, expiresAt
+}
+
+// storyAPISource reads a story from the media info API, Instagram only answers it for some stories without login
+type storyAPISource struct{}
+
+func (storyAPISource) Name() string { return "storyapi" }
+
+func (storyAPISource) Fetch(ctx context.Context, postID string) (*InstaData, error) {
+	_, mediaID, ok := parseStoryID(postID)
+	if !ok {
+		return nil, errSourceDisabled
+	}
+
+	data, err := fetchAPI(ctx, "/api/v1/media/"+mediaID+"/info/")
+	if err != nil {
+		return nil, err
+	}
+	item := data.Get("items.0")
+	if !item.Exists() {
+		return nil, ErrNotFound
+	}
+	i := &InstaData{PostID: postID}
+	i.parseMediaItem(item)
+	if len(i.Username) == 0 || len(i.Medias) == 0 {
+		return nil, fmt.Errorf("%w: media info has no media", ErrUpstreamChanged)
+	}
+	return i, nil
+}
+
+// parseMediaItem fills i from a private API media item (media info, reels and stories feeds)
+func (i *InstaData) parseMediaItem(item gjson.Result) {
+	i.Username = item.Get("user.username").String()
+	i.FullName = item.Get("user.full_name").String()
+	i.IsVerified = item.Get("user.is_verified").Bool()
+	i.Caption = strings.TrimSpace(item.Get("caption.text").String())
+	i.Location = item.Get("location.name").String()
+	i.Timestamp = item.Get("taken_at").Int()
+	i.Likes = item.Get("like_count").Int()
+	i.Comments = item.Get("comment_count").Int()
+	i.Views = item.Get("play_count").Int()
+
+	media := []gjson.Result{item}
+	if item.Get("carousel_media").Exists() {
+		media = item.Get("carousel_media").Array()
+	}
+	i.Medias = parseMediaVersions(media)
+}
+
+// parseMediaVersions picks the best image or video of private API media items
+func parseMediaVersions(media []gjson.Result) []Media {
+	medias := make([]Media, 0, len(media))
+	for _, m := range media {
+		image := m.Get("image_versions2.candidates.0")
+		video := m.Get("video_versions.0")
+		width, height := m.Get("original_width").Int(), m.Get("original_height").Int()
+		if video.Exists() {
+			medias = append(medias, Media{
+				TypeName:     "GraphVideo",
+				URL:          video.Get("url").String(),
+				ThumbnailURL: image.Get("url").String(),
+				Width:        int(width),
+				Height:       int(height),
+			})
+		} else if image.Exists() {
+			medias = append(medias, Media{
+				TypeName: "GraphImage",
+				URL:      image.Get("url").String(),
+				Width:    int(width),
+				Height:   int(height),
+			})
+		}
+	}
+	return medias
+}
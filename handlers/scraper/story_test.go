@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseStoryID(t *testing.T) {
+	tests := []struct {
+		postID            string
+		username, mediaID string
+		ok                bool
+	}{
+		{postID: StoryID("some.user_1", "3158392745896040411"), username: "some.user_1", mediaID: "3158392745896040411", ok: true},
+		{postID: StoryID("Some.User_1", "3158392745896040411"), username: "some.user_1", mediaID: "3158392745896040411", ok: true},
+		{postID: "story:someone:"},
+		{postID: "story::3158392745896040411"},
+		{postID: "story:someone:31583927x5896040411"},
+		{postID: "story:some/one:3158392745896040411"},
+		{postID: "CSidecar001"},
+	}
+	for _, tt := range tests {
+		username, mediaID, ok := parseStoryID(tt.postID)
+		if username != tt.username || mediaID != tt.mediaID || ok != tt.ok {
+			t.Errorf("%s: got %q, %q, %v, want %q, %q, %v", tt.postID, username, mediaID, ok, tt.username, tt.mediaID, tt.ok)
+		}
+		if tt.ok && !validPostID(tt.postID) {
+			t.Errorf("%s: story is not a valid postID", tt.postID)
+		}
+	}
+}
+
+func TestStoryCacheTimes(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		postedAt  time.Time
+		expiresAt time.Time
+	}{
+		{name: "unknown", expiresAt: now.Add(storyLifetime)},
+		{name: "fresh", postedAt: now.Add(-time.Hour), expiresAt: now.Add(storyLifetime - time.Hour)},
+		{name: "gone", postedAt: now.Add(-2 * storyLifetime), expiresAt: now.Add(StoryStaleTTL)},
+	}
+	for _, tt := range tests {
+		i := &InstaData{}
+		if !tt.postedAt.IsZero() {
+			i.Timestamp = tt.postedAt.Unix()
+		}
+		staleAt, expiresAt := i.storyCacheTimes(now)
+		if !staleAt.Equal(now.Add(StoryStaleTTL)) {
+			t.Errorf("%s: stale at %v, want %v", tt.name, staleAt, now.Add(StoryStaleTTL))
+		}
+		// Timestamp is in seconds
+		if d := expiresAt.Sub(tt.expiresAt); d <= -time.Second || d >= time.Second {
+			t.Errorf("%s: expires at %v, want %v", tt.name, expiresAt, tt.expiresAt)
+		}
+	}
+}
+
+func TestPlatformSources(t *testing.T) {
+	// The remote scraper only has a post endpoint, it isn't asked for these even when configured
+	tests := []struct {
+		postID string
+		want   []string
+	}{
+		{postID: StoryID("someone", "3158392745896040411"), want: []string{"storyapi"}},
+		{postID: HighlightID("17900000000000001"), want: []string{"highlightapi"}},
+	}
+	for _, tt := range tests {
+		p, _ := platformOf(tt.postID)
+		var names []string
+		for _, s := range p.Sources {
+			names = append(names, s.Name())
+		}
+		if !slices.Equal(names, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.postID, names, tt.want)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+// Package threads scrapes Threads posts into the same InstaData as Instagram posts,
+// so they share the cache, the embed template and the media routes.
+package threads
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	scraper "instafix/handlers/scraper"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/klauspost/compress/gzhttp"
+)
+
+// Threads posts are cached as threads:{code}, Threads and Instagram codes look alike
+const prefix = "threads:"
+
+var (
+	ThreadsURL = "https://www.threads.net"
+	transport  = gzhttp.Transport(http.DefaultTransport, gzhttp.TransportAlwaysDecompress(true))
+)
+
+func init() {
+	scraper.RegisterPlatform(scraper.Platform{
+		Prefix:  prefix,
+		Valid:   validPostID,
+		URL:     postURL,
+		Sources: []scraper.Source{embedSource{}},
+	})
+}
+
+// PostID returns the postID of the Threads post code
+func PostID(code string) string {
+	return prefix + code
+}
+
+func validPostID(postID string) bool {
+	code, ok := strings.CutPrefix(postID, prefix)
+	if !ok || len(code) == 0 {
+		return false
+	}
+	for _, c := range code {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func postURL(postID string) string {
+	return "https://www.threads.net/t/" + strings.TrimPrefix(postID, prefix)
+}
+
+// embedSource parses the embed page of a post, it is built like Instagram's /embed/captioned/
+type embedSource struct{}
+
+func (embedSource) Name() string { return "threads" }
+
+func (embedSource) Fetch(ctx context.Context, postID string) (*scraper.InstaData, error) {
+	code := strings.TrimPrefix(postID, prefix)
+	client := http.Client{Transport: transport, Timeout: scraper.Timeout}
+	req, err := http.NewRequestWithContext(ctx, "GET", ThreadsURL+"/t/"+code+"/embed/", nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", scraper.ErrNetwork, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, scraper.StatusError(res.StatusCode)
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", scraper.ErrNetwork, err)
+	}
+
+	i, err := parseEmbed(body)
+	if err != nil {
+		return nil, err
+	}
+	i.PostID = postID
+	return i, nil
+}
+
+func parseEmbed(body []byte) (*scraper.InstaData, error) {
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", scraper.ErrUpstreamChanged, err)
+	}
+
+	header := doc.Find(".HeaderContainer")
+	i := &scraper.InstaData{
+		Username:   strings.TrimSpace(header.Find(".NameContainer").First().Text()),
+		IsVerified: header.Find(`[aria-label="Verified"]`).Length() > 0,
+		Caption:    strings.TrimSpace(doc.Find(".BodyTextContainer").First().Text()),
+	}
+	if len(i.Username) == 0 {
+		// Deleted and private posts still render the page, without anyone in it
+		return nil, scraper.ErrNotFound
+	}
+	if datetime, ok := header.Find("time").Attr("datetime"); ok {
+		if t, err := time.Parse(time.RFC3339, datetime); err == nil {
+			i.Timestamp = t.Unix()
+		}
+	}
+
+	doc.Find(".MediaContainer img, .MediaContainer video").Each(func(_ int, s *goquery.Selection) {
+		if goquery.NodeName(s) == "img" {
+			i.Medias = append(i.Medias, scraper.Media{TypeName: "GraphImage", URL: s.AttrOr("src", "")})
+			return
+		}
+		videoURL, ok := s.Attr("src")
+		if !ok {
+			videoURL = s.Find("source").AttrOr("src", "")
+		}
+		i.Medias = append(i.Medias, scraper.Media{TypeName: "GraphVideo", URL: videoURL, ThumbnailURL: s.AttrOr("poster", "")})
+	})
+
+	// Text only, show the author instead so the post is still cached and embedded
+	if len(i.Medias) == 0 {
+		avatarURL, ok := header.Find("img").Attr("src")
+		if !ok {
+			return nil, fmt.Errorf("%w: post has no media or avatar", scraper.ErrUpstreamChanged)
+		}
+		i.Medias = append(i.Medias, scraper.Media{TypeName: "GraphImage", URL: avatarURL})
+	}
+	for _, m := range i.Medias {
+		if len(m.URL) == 0 {
+			return nil, fmt.Errorf("%w: media without URL", scraper.ErrUpstreamChanged)
+		}
+	}
+	return i, nil
+}
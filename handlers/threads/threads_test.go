@@ -0,0 +1,66 @@
+package threads
+
+import (
+	"context"
+	"errors"
+	scraper "instafix/handlers/scraper"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestEmbedSource(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /t/{code}/embed/", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "testdata/"+r.PathValue("code")+".html")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	oldURL := ThreadsURL
+	ThreadsURL = server.URL
+	defer func() { ThreadsURL = oldURL }()
+
+	tests := []struct {
+		code string
+		want *scraper.InstaData
+		err  error
+	}{
+		{code: "media", want: &scraper.InstaData{
+			PostID: PostID("media"), Username: "threadsuser", IsVerified: true,
+			Caption: "Two photos\nand a video", Timestamp: 1718406700,
+			Medias: []scraper.Media{
+				{TypeName: "GraphImage", URL: "https://scontent-sin6-1.cdninstagram.com/v/t51.2885-15/one.jpg?oe=66700000"},
+				{TypeName: "GraphVideo", URL: "https://scontent-sin6-1.cdninstagram.com/o1/v/t16/video.mp4?oe=66700000", ThumbnailURL: "https://scontent-sin6-1.cdninstagram.com/v/t51.2885-15/poster.jpg?oe=66700000"},
+				{TypeName: "GraphImage", URL: "https://scontent-sin6-1.cdninstagram.com/v/t51.2885-15/two.jpg?oe=66700000"},
+			},
+		}},
+		{code: "text", want: &scraper.InstaData{
+			PostID: PostID("text"), Username: "textuser", Caption: "Just words",
+			Medias: []scraper.Media{{TypeName: "GraphImage", URL: "https://scontent-sin6-1.cdninstagram.com/v/t51.2885-19/text_avatar.jpg"}},
+		}},
+		{code: "deleted", err: scraper.ErrNotFound},
+		{code: "missing", err: scraper.ErrNotFound},
+	}
+	for _, tt := range tests {
+		got, err := embedSource{}.Fetch(context.Background(), PostID(tt.code))
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: got error %v, want %v", tt.code, err, tt.err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestPlatform(t *testing.T) {
+	if got, want := scraper.PostURL(PostID("C8abc-_1")), "https://www.threads.net/t/C8abc-_1"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	for postID, want := range map[string]bool{PostID("C8abc-_1"): true, PostID(""): false, PostID("../x"): false, "C8abc": false} {
+		if got := validPostID(postID); got != want {
+			t.Errorf("%s: valid is %v, want %v", postID, got, want)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	scraper "instafix/handlers/scraper"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func Thumbnails(w http.ResponseWriter, r *http.Request) {
+	postID := chi.URLParam(r, "postID")
+	mediaNum, err := strconv.Atoi(chi.URLParam(r, "mediaNum"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	item, err := scraper.GetData(r.Context(), postID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Redirect to poster URL, images are their own thumbnail
+	if mediaNum > len(item.Medias) {
+		return
+	}
+	media := item.Medias[max(1, mediaNum)-1]
+	thumbnailURL := media.ThumbnailURL
+	if len(thumbnailURL) == 0 {
+		thumbnailURL = media.URL
+	}
+	if ProxyMedia {
+		proxyMediaURL(w, r, thumbnailURL)
+		return
+	}
+	http.Redirect(w, r, thumbnailURL, http.StatusFound)
+}
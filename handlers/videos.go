@@ -19,7 +19,7 @@ func Videos(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	item, err := scraper.GetData(postID)
+	item, err := scraper.GetData(r.Context(), postID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -30,6 +30,10 @@ func Videos(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	videoURL := item.Medias[max(1, mediaNum)-1].URL
+	if ProxyMedia {
+		proxyMediaURL(w, r, videoURL)
+		return
+	}
 
 	// Redirect to proxy if not TelegramBot in User-Agent
 	if strings.Contains(r.Header.Get("User-Agent"), "TelegramBot") {
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"instafix/config"
 	"instafix/handlers"
 	scraper "instafix/handlers/scraper"
 	"instafix/utils"
@@ -10,128 +13,146 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
-	"strconv"
 	"strings"
-	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	bolt "go.etcd.io/bbolt"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-func init() {
-	// Create static folder if not exists
-	os.Mkdir("static", 0755)
+// fatal logs err and exits, used for errors before the server is up
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
 }
 
 func main() {
-	listenAddr := flag.String("listen", "0.0.0.0:3000", "Address to listen on")
-	gridCacheMaxFlag := flag.String("grid-cache-entries", "1024", "Maximum number of grid images to cache")
-	remoteScraperAddr := flag.String("remote-scraper", "", "Remote scraper address (https://github.com/Wikidepia/InstaFix-remote-scraper)")
-	videoProxyAddr := flag.String("video-proxy-addr", "", "Video proxy address (https://github.com/Wikidepia/InstaFix-proxy)")
-	flag.Parse()
-
-	// Initialize remote scraper
-	if *remoteScraperAddr != "" {
-		if !strings.HasPrefix(*remoteScraperAddr, "http") {
-			panic("Remote scraper address must start with http:// or https://")
-		}
-		scraper.RemoteScraperAddr = *remoteScraperAddr
+	cfg, err := config.Load(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid config:", err)
+		os.Exit(2)
+	}
+
+	// Initialize logging
+	level, _ := cfg.SlogLevel()
+	slog.SetLogLoggerLevel(level)
+
+	// Initialize scraper
+	scraper.RemoteScraperAddr = cfg.RemoteScraper
+	scraper.Timeout = cfg.ScrapeTimeout
+	scraper.CDNHost = cfg.CDNHost
+	scraper.StaleTTL = cfg.StaleTTL
+	scraper.ExpireTTL = cfg.ExpireTTL
+	scraper.StoryStaleTTL = cfg.StoryStaleTTL
+	scraper.ProfileTTL = cfg.ProfileTTL
+	scraper.CachePath = cfg.CachePath
+	scraper.StaticDir = cfg.StaticDir
+	scraper.EvictInterval = cfg.EvictInterval
+	if err := scraper.SetSources(cfg.ScrapeSources); err != nil {
+		fatal("Invalid scrape sources", err)
 	}
 
+	handlers.HostModes = cfg.HostModes
+
 	// Initialize video proxy
-	if *videoProxyAddr != "" {
-		if !strings.HasPrefix(*videoProxyAddr, "http") {
-			panic("Video proxy address must start with http:// or https://")
-		}
-		handlers.VideoProxyAddr = *videoProxyAddr
+	if cfg.VideoProxyAddr != "" {
+		handlers.VideoProxyAddr = cfg.VideoProxyAddr
 		if !strings.HasSuffix(handlers.VideoProxyAddr, "/") {
 			handlers.VideoProxyAddr += "/"
 		}
 	}
 
-	// Initialize logging
-	slog.SetLogLoggerLevel(slog.LevelError)
+	// Initialize built-in media proxy
+	handlers.ProxyMedia = cfg.ProxyMedia
+	if cfg.ProxyMedia && cfg.ProxyCacheDir != "" {
+		if err := handlers.InitProxyCache(cfg.ProxyCacheDir, cfg.ProxyCacheEntries, int64(cfg.ProxyCacheSize)<<20); err != nil {
+			fatal("Failed to initialize proxy cache", err)
+		}
+	}
 
-	// Initialize LRU
-	gridCacheMax, err := strconv.Atoi(*gridCacheMaxFlag)
-	if err != nil || gridCacheMax <= 0 {
-		panic(err)
+	// Initialize grid
+	handlers.GridTimeout = cfg.GridTimeout
+	handlers.GridJPEGQuality = cfg.GridJPEGQuality
+	if err := scraper.InitLRU(cfg.GridCacheEntries); err != nil {
+		fatal("Failed to initialize grid cache", err)
 	}
-	scraper.InitLRU(gridCacheMax)
 
 	// Initialize cache / DB
-	scraper.InitDB()
+	if err := scraper.InitDB(cfg.Cache); err != nil {
+		fatal("Failed to open cache", err)
+	}
 	defer scraper.DB.Close()
 
-	// Evict cache every minute
-	go func() {
-		for {
-			evictCache()
-			time.Sleep(5 * time.Minute)
-		}
-	}()
-
-	go func() {
-		http.ListenAndServe("localhost:6060", nil)
-	}()
+	if cfg.PprofListen != "" {
+		go func() {
+			http.ListenAndServe(cfg.PprofListen, nil)
+		}()
+	}
 
 	r := chi.NewRouter()
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.StripSlashes)
+	r.Use(handlers.Metrics)
 
-	r.Get("/tv/{postID}", handlers.Embed)
-	r.Get("/reel/{postID}", handlers.Embed)
-	r.Get("/reels/{postID}", handlers.Embed)
-	r.Get("/stories/{username}/{postID}", handlers.Embed)
-	r.Get("/p/{postID}", handlers.Embed)
-	r.Get("/p/{postID}/{mediaNum}", handlers.Embed)
-
-	r.Get("/{username}/p/{postID}", handlers.Embed)
-	r.Get("/{username}/p/{postID}/{mediaNum}", handlers.Embed)
-	r.Get("/{username}/reel/{postID}", handlers.Embed)
+	for _, link := range utils.LinkPatterns {
+		r.Get(link.Pattern, handlers.Embed)
+	}
 
-	r.Get("/images/{postID}/{mediaNum}", handlers.Images)
-	r.Get("/videos/{postID}/{mediaNum}", handlers.Videos)
+	// Media answers HEAD too, players check it before streaming
+	for pattern, handler := range map[string]http.HandlerFunc{
+		"/images/{postID}/{mediaNum}":     handlers.Images,
+		"/images/profile/{username}":      handlers.ProfileAvatar,
+		"/videos/{postID}/{mediaNum}":     handlers.Videos,
+		"/thumbnails/{postID}/{mediaNum}": handlers.Thumbnails,
+		"/covers/{postID}":                handlers.Covers,
+	} {
+		r.Get(pattern, handler)
+		r.Head(pattern, handler)
+	}
 	r.Get("/grid/{postID}", handlers.Grid)
+	r.Get("/grid/profile/{username}", handlers.ProfileGrid)
 	r.Get("/oembed", handlers.OEmbed)
+	r.Route("/api/v1", func(r chi.Router) {
+		r.Get("/post/{postID}", handlers.APIPost)
+	})
+
+	admin := chi.NewRouter()
+	admin.Use(handlers.AdminAuth(cfg.AdminToken))
+	admin.Get("/stats", handlers.AdminStats)
+	admin.Get("/post/{postID}", handlers.AdminPost)
+	admin.Post("/post/{postID}/refresh", handlers.AdminRefresh)
+	admin.Delete("/post/{postID}", handlers.AdminPurge)
+	// Metrics are on the admin listen address, or on the public one only if asked for
+	metrics := handlers.AdminAuth(cfg.AdminToken)(promhttp.Handler())
+	if cfg.AdminListen != "" {
+		adminRouter := chi.NewRouter()
+		adminRouter.Use(middleware.Recoverer)
+		adminRouter.Use(middleware.StripSlashes)
+		adminRouter.Mount("/admin", admin)
+		adminRouter.Handle("/metrics", metrics)
+		go func() {
+			if err := http.ListenAndServe(cfg.AdminListen, adminRouter); err != nil {
+				slog.Error("Failed to listen for admin", "err", err)
+			}
+		}()
+	} else {
+		if cfg.PublicMetrics {
+			r.Handle("/metrics", metrics)
+		}
+		if cfg.AdminToken != "" {
+			r.Mount("/admin", admin)
+		}
+	}
+
 	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		views.Home(w)
 	})
 
-	println("Starting up on", *listenAddr)
-	if err := http.ListenAndServe(*listenAddr, r); err != nil {
+	println("Starting up on", cfg.Listen)
+	if err := http.ListenAndServe(cfg.Listen, r); err != nil {
 		slog.Error("Failed to listen", "err", err)
 	}
 }
-
-// Remove cache from Pebble if already expired
-func evictCache() {
-	curTime := time.Now().UnixNano()
-	err := scraper.DB.Batch(func(tx *bolt.Tx) error {
-		ttlBucket := tx.Bucket([]byte("ttl"))
-		if ttlBucket == nil {
-			return nil
-		}
-		dataBucket := tx.Bucket([]byte("data"))
-		if dataBucket == nil {
-			return nil
-		}
-		c := ttlBucket.Cursor()
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			if n, err := strconv.ParseInt(utils.B2S(k), 10, 64); err == nil {
-				if n < curTime {
-					ttlBucket.Delete(k)
-					dataBucket.Delete(v)
-				}
-			} else {
-				slog.Error("Failed to parse expire timestamp in cache", "err", err)
-			}
-		}
-		return nil
-	})
-	if err != nil {
-		slog.Error("Failed to evict cache", "err", err)
-	}
-}
@@ -47,3 +47,33 @@ func IsBot(userAgent string) bool {
 	}
 	return false
 }
+
+// Bot families reported in metrics, checked in order before the generic knownBots
+var botFamilies = []string{
+	"discord",
+	"telegram",
+	"twitter",
+	"facebook",
+	"whatsapp",
+	"slack",
+	"skype",
+	"mastodon",
+	"revoltchat",
+	"vkshare",
+	"curl",
+	"python",
+}
+
+// BotFamily returns the bot family of userAgent, "other" for unknown bots and "none" for browsers
+func BotFamily(userAgent string) string {
+	lower := strings.ToLower(userAgent)
+	for _, family := range botFamilies {
+		if strings.Contains(lower, family) {
+			return family
+		}
+	}
+	if IsBot(userAgent) {
+		return "other"
+	}
+	return "none"
+}
@@ -0,0 +1,180 @@
+package utils
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Kinds of Instagram links
+const (
+	LinkPost      = "post"      // ID is a post shortcode
+	LinkStory     = "story"     // ID is a numeric media ID
+	LinkHighlight = "highlight" // ID is a numeric highlight ID
+	LinkShare     = "share"     // ID has to be resolved to a post by following Instagram's redirect
+	LinkAudio     = "audio"     // ID is an audio page, there's nothing to embed
+	LinkProfile   = "profile"   // Username is the profile, there's no ID
+	LinkThreads   = "threads"   // ID is a Threads post code, the link is on threads.net
+)
+
+var (
+	ErrNotInstagramLink = errors.New("not an Instagram link")
+	ErrInvalidMediaNum  = errors.New("invalid media number")
+)
+
+// Link is an Instagram link reduced to what it points at
+type Link struct {
+	Kind     string
+	ID       string
+	Username string // Empty unless the link has one
+	MediaNum int    // 0 for the whole post
+	Path     string // Canonical path on instagram.com, without tracking params
+}
+
+// URL returns the canonical Instagram (or Threads) URL of l
+func (l Link) URL() string {
+	u := "https://www.instagram.com" + l.Path
+	if l.Kind == LinkThreads {
+		u = "https://www.threads.net" + l.Path
+	}
+	if l.MediaNum > 0 {
+		u += "?img_index=" + strconv.Itoa(l.MediaNum)
+	}
+	return u
+}
+
+// LinkPattern is a link form, Pattern uses chi syntax so routes can be registered from it,
+// a parameter may follow a literal prefix in its segment (@{username}).
+// Canonical is the instagram.com path with the same parameters.
+type LinkPattern struct {
+	Pattern   string
+	Kind      string
+	Canonical string
+}
+
+// LinkPatterns are every supported link form, literal segments must come before
+// parameters in the same position (share before {username}) like chi routes them
+var LinkPatterns = []LinkPattern{
+	{"/p/{postID}", LinkPost, "/p/{postID}/"},
+	{"/p/{postID}/{mediaNum}", LinkPost, "/p/{postID}/"},
+	{"/reel/{postID}", LinkPost, "/reel/{postID}/"},
+	{"/reels/{postID}", LinkPost, "/reel/{postID}/"},
+	{"/tv/{postID}", LinkPost, "/tv/{postID}/"},
+	{"/reels/audio/{postID}", LinkAudio, "/reels/audio/{postID}/"},
+	{"/stories/highlights/{postID}", LinkHighlight, "/stories/highlights/{postID}/"},
+	{"/stories/{username}/{postID}", LinkStory, "/stories/{username}/{postID}/"},
+	{"/share/{postID}", LinkShare, "/share/{postID}/"},
+	{"/share/p/{postID}", LinkShare, "/share/p/{postID}/"},
+	{"/share/reel/{postID}", LinkShare, "/share/reel/{postID}/"},
+	{"/{username}/p/{postID}", LinkPost, "/p/{postID}/"},
+	{"/{username}/p/{postID}/{mediaNum}", LinkPost, "/p/{postID}/"},
+	{"/{username}/reel/{postID}", LinkPost, "/reel/{postID}/"},
+	{"/{username}", LinkProfile, "/{username}/"},
+	{"/@{username}/post/{postID}", LinkThreads, "/@{username}/post/{postID}"},
+	{"/t/{postID}", LinkThreads, "/t/{postID}"},
+}
+
+// reservedNames are Instagram pages, not usernames
+var reservedNames = map[string]bool{
+	"p": true, "reel": true, "reels": true, "tv": true, "stories": true, "share": true,
+	"explore": true, "accounts": true, "direct": true, "about": true, "legal": true, "developer": true,
+	"api": true, "web": true,
+}
+
+// fileExtensions end the names of files crawlers ask for (sitemap.xml, ads.txt, xmlrpc.php),
+// usernames may have dots but not these
+var fileExtensions = map[string]bool{
+	"txt": true, "xml": true, "ico": true, "json": true, "php": true, "html": true, "htm": true,
+	"js": true, "css": true, "png": true, "jpg": true, "gif": true, "svg": true, "webmanifest": true,
+}
+
+// isUsername reports whether name can be an Instagram username: up to 30 letters, digits,
+// underscores and dots, without a dot at either end, two dots in a row or a file extension
+func isUsername(name string) bool {
+	if len(name) == 0 || len(name) > 30 || reservedNames[name] {
+		return false
+	}
+	if name[0] == '.' || name[len(name)-1] == '.' || strings.Contains(name, "..") {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_') {
+			return false
+		}
+	}
+	if n := strings.LastIndexByte(name, '.'); n >= 0 && fileExtensions[strings.ToLower(name[n+1:])] {
+		return false
+	}
+	return true
+}
+
+// ParseLink normalizes any Instagram (or InstaFix) link, e.g. instagr.am/p/{postID}/?igsh=...
+func ParseLink(rawURL string) (Link, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return Link{}, err
+	}
+	return MatchLink(u.Path, u.Query())
+}
+
+// MatchLink normalizes the path and query of an Instagram link
+func MatchLink(path string, query url.Values) (Link, error) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for _, p := range LinkPatterns {
+		params, ok := matchPattern(p.Pattern, segments)
+		if !ok {
+			continue
+		}
+		if username, ok := params["username"]; ok && !isUsername(username) {
+			continue
+		}
+
+		var err error
+		link := Link{Kind: p.Kind, ID: params["postID"], Username: params["username"]}
+		if mediaNum, ok := params["mediaNum"]; ok {
+			if link.MediaNum, err = strconv.Atoi(mediaNum); err != nil {
+				return Link{}, ErrInvalidMediaNum
+			}
+		}
+		if imgIndex := query.Get("img_index"); imgIndex != "" {
+			if link.MediaNum, err = strconv.Atoi(imgIndex); err != nil {
+				return Link{}, ErrInvalidMediaNum
+			}
+		}
+		link.MediaNum = max(0, link.MediaNum)
+
+		link.Path = p.Canonical
+		for name, value := range params {
+			link.Path = strings.Replace(link.Path, "{"+name+"}", value, 1)
+		}
+		return link, nil
+	}
+	return Link{}, ErrNotInstagramLink
+}
+
+func matchPattern(pattern string, segments []string) (map[string]string, bool) {
+	parts := strings.Split(strings.Trim(pattern, "/"), "/")
+	if len(parts) != len(segments) {
+		return nil, false
+	}
+	params := make(map[string]string, len(parts))
+	for n, part := range parts {
+		if segments[n] == "" {
+			return nil, false
+		}
+		prefix, param, ok := strings.Cut(part, "{")
+		if !ok {
+			if part != segments[n] {
+				return nil, false
+			}
+			continue
+		}
+		value, ok := strings.CutPrefix(segments[n], prefix)
+		if !ok || value == "" {
+			return nil, false
+		}
+		params[strings.TrimSuffix(param, "}")] = value
+	}
+	return params, true
+}
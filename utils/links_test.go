@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseLink(t *testing.T) {
+	tests := []struct {
+		url  string
+		want Link
+		err  error
+	}{
+		{url: "https://www.instagram.com/p/CSidecar001/", want: Link{Kind: LinkPost, ID: "CSidecar001", Path: "/p/CSidecar001/"}},
+		{url: "https://instagr.am/p/CSidecar001?igsh=MWx0b2U=", want: Link{Kind: LinkPost, ID: "CSidecar001", Path: "/p/CSidecar001/"}},
+		{url: "https://www.instagram.com/p/CSidecar001/?img_index=3", want: Link{Kind: LinkPost, ID: "CSidecar001", MediaNum: 3, Path: "/p/CSidecar001/"}},
+		{url: "https://ddinstagram.com/p/CSidecar001/2", want: Link{Kind: LinkPost, ID: "CSidecar001", MediaNum: 2, Path: "/p/CSidecar001/"}},
+		{url: "https://www.instagram.com/reels/CReel000001/", want: Link{Kind: LinkPost, ID: "CReel000001", Path: "/reel/CReel000001/"}},
+		{url: "https://www.instagram.com/tv/CTv00000001", want: Link{Kind: LinkPost, ID: "CTv00000001", Path: "/tv/CTv00000001/"}},
+		{url: "https://www.instagram.com/someone/p/CSidecar001/?utm_source=ig_web_copy_link", want: Link{Kind: LinkPost, ID: "CSidecar001", Username: "someone", Path: "/p/CSidecar001/"}},
+		{url: "https://www.instagram.com/someone/reel/CReel000001/", want: Link{Kind: LinkPost, ID: "CReel000001", Username: "someone", Path: "/reel/CReel000001/"}},
+		{url: "https://www.instagram.com/stories/someone/3158392745896040411/", want: Link{Kind: LinkStory, ID: "3158392745896040411", Username: "someone", Path: "/stories/someone/3158392745896040411/"}},
+		{url: "https://www.instagram.com/stories/highlights/17900000000000001/?igsh=abc", want: Link{Kind: LinkHighlight, ID: "17900000000000001", Path: "/stories/highlights/17900000000000001/"}},
+		{url: "https://www.instagram.com/share/BAbCdEf12", want: Link{Kind: LinkShare, ID: "BAbCdEf12", Path: "/share/BAbCdEf12/"}},
+		{url: "https://www.instagram.com/share/reel/BAbCdEf12/?igsh=abc", want: Link{Kind: LinkShare, ID: "BAbCdEf12", Path: "/share/reel/BAbCdEf12/"}},
+		{url: "https://www.instagram.com/share/p/BAbCdEf12/", want: Link{Kind: LinkShare, ID: "BAbCdEf12", Path: "/share/p/BAbCdEf12/"}},
+		{url: "https://www.instagram.com/reels/audio/1234567890/", want: Link{Kind: LinkAudio, ID: "1234567890", Path: "/reels/audio/1234567890/"}},
+		{url: "https://www.threads.net/@someone/post/C8abc-_1?xmt=abc", want: Link{Kind: LinkThreads, ID: "C8abc-_1", Username: "someone", Path: "/@someone/post/C8abc-_1"}},
+		{url: "https://www.threads.net/t/C8abc-_1", want: Link{Kind: LinkThreads, ID: "C8abc-_1", Path: "/t/C8abc-_1"}},
+		{url: "https://www.instagram.com/p/CSidecar001/?img_index=abc", err: ErrInvalidMediaNum},
+		{url: "https://www.instagram.com/someone/?hl=en", want: Link{Kind: LinkProfile, Username: "someone", Path: "/someone/"}},
+		{url: "https://www.instagram.com/someone/saved/", err: ErrNotInstagramLink},
+		{url: "https://www.instagram.com/", err: ErrNotInstagramLink},
+		{url: "https://www.instagram.com/explore/", err: ErrNotInstagramLink},
+		{url: "https://www.instagram.com/p/", err: ErrNotInstagramLink},
+		{url: "https://www.instagram.com/some.one_1/", want: Link{Kind: LinkProfile, Username: "some.one_1", Path: "/some.one_1/"}},
+		{url: "https://ddinstagram.com/robots.txt", err: ErrNotInstagramLink},
+		{url: "https://ddinstagram.com/sitemap.xml", err: ErrNotInstagramLink},
+		{url: "https://ddinstagram.com/ads.txt", err: ErrNotInstagramLink},
+		{url: "https://ddinstagram.com/humans.txt", err: ErrNotInstagramLink},
+		{url: "https://ddinstagram.com/app-ads.txt", err: ErrNotInstagramLink},
+		{url: "https://ddinstagram.com/xmlrpc.php", err: ErrNotInstagramLink},
+		{url: "https://ddinstagram.com/.env", err: ErrNotInstagramLink},
+		{url: "https://ddinstagram.com/.well-known/security.txt", err: ErrNotInstagramLink},
+		{url: "https://ddinstagram.com/.well-known/p/CSidecar001", err: ErrNotInstagramLink},
+		{url: "https://ddinstagram.com/someone./", err: ErrNotInstagramLink},
+		{url: "https://ddinstagram.com/some..one/", err: ErrNotInstagramLink},
+		{url: "https://ddinstagram.com/thirty.one.characters.usernames/", err: ErrNotInstagramLink},
+	}
+	for _, tt := range tests {
+		got, err := ParseLink(tt.url)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: got error %v, want %v", tt.url, err, tt.err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestLinkURL(t *testing.T) {
+	link, err := ParseLink("https://ddinstagram.com/reels/CReel000001/?img_index=2&igsh=abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := link.URL(), "https://www.instagram.com/reel/CReel000001/?img_index=2"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	link, err = ParseLink("https://ddinstagram.com/@someone/post/C8abc-_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := link.URL(), "https://www.threads.net/@someone/post/C8abc-_1"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,108 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+)
+
+type flightCall struct {
+	done    chan struct{}
+	val     interface{}
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+	panic   *PanicError // fn panicked, waiters panic with it instead of returning
+}
+
+// PanicError is what waiters panic with when fn panicked, fn runs in its own goroutine
+// so the panic is carried over to the callers where it can be recovered
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (p *PanicError) Error() string {
+	return fmt.Sprintf("%v\n\n%s", p.Value, p.Stack)
+}
+
+// FlightGroup is like singleflight.Group, but the function gets a context
+// that stays alive while any caller is still waiting for it
+// and is canceled once the last waiter goes away.
+type FlightGroup struct {
+	mu sync.Mutex
+	m  map[string]*flightCall
+
+	deduplicated atomic.Uint64
+}
+
+// Do executes and returns the results of fn, making sure that only one execution
+// is in-flight for a given key at a time. shared reports whether the result
+// was given to multiple callers.
+func (g *FlightGroup) Do(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (v interface{}, err error, shared bool) {
+	g.mu.Lock()
+	if g.m == nil {
+		g.m = make(map[string]*flightCall)
+	}
+	if c, ok := g.m[key]; ok {
+		c.waiters++
+		g.mu.Unlock()
+		g.deduplicated.Add(1)
+		return g.wait(ctx, key, c, true)
+	}
+
+	// Values are kept, cancellation is handled by the waiters
+	fnCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	c := &flightCall{done: make(chan struct{}), waiters: 1, cancel: cancel}
+	g.m[key] = c
+	g.mu.Unlock()
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				c.panic = &PanicError{Value: r, Stack: debug.Stack()}
+			}
+			g.mu.Lock()
+			if g.m[key] == c {
+				delete(g.m, key)
+			}
+			g.mu.Unlock()
+			cancel()
+			close(c.done)
+		}()
+		c.val, c.err = fn(fnCtx)
+	}()
+	return g.wait(ctx, key, c, false)
+}
+
+func (g *FlightGroup) wait(ctx context.Context, key string, c *flightCall, shared bool) (interface{}, error, bool) {
+	select {
+	case <-c.done:
+		g.mu.Lock()
+		shared = shared || c.waiters > 1
+		g.mu.Unlock()
+		if c.panic != nil {
+			panic(c.panic)
+		}
+		return c.val, c.err, shared
+	case <-ctx.Done():
+		g.mu.Lock()
+		c.waiters--
+		if c.waiters == 0 {
+			c.cancel()
+			// Let the next caller start a fresh call instead of joining a canceled one
+			if g.m[key] == c {
+				delete(g.m, key)
+			}
+		}
+		g.mu.Unlock()
+		return nil, ctx.Err(), shared
+	}
+}
+
+// Deduplicated returns how many calls joined an in-flight call instead of executing fn
+func (g *FlightGroup) Deduplicated() uint64 {
+	return g.deduplicated.Load()
+}
@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlightGroupDedup(t *testing.T) {
+	var g FlightGroup
+	var calls atomic.Int32
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		calls.Add(1)
+		<-release
+		return "ok", nil
+	}
+
+	results := make(chan interface{}, 2)
+	for range 2 {
+		go func() {
+			v, _, _ := g.Do(context.Background(), "key", fn)
+			results <- v
+		}()
+	}
+	waitWaiters(t, &g, "key", 2)
+	close(release)
+
+	for range 2 {
+		if v := <-results; v != "ok" {
+			t.Errorf("got %v, want ok", v)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("fn called %d times, want 1", n)
+	}
+	if n := g.Deduplicated(); n != 1 {
+		t.Errorf("got %d deduplicated calls, want 1", n)
+	}
+}
+
+func TestFlightGroupCancelLastWaiter(t *testing.T) {
+	var g FlightGroup
+	fnCtx := make(chan context.Context, 1)
+	fn := func(ctx context.Context) (interface{}, error) {
+		fnCtx <- ctx
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	errs := make(chan error, 2)
+	go func() { _, err, _ := g.Do(ctx1, "key", fn); errs <- err }()
+	ctx := <-fnCtx
+	go func() { _, err, _ := g.Do(ctx2, "key", fn); errs <- err }()
+	waitWaiters(t, &g, "key", 2)
+
+	// First waiter leaves, the call must keep running for the second one
+	cancel1()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Errorf("first waiter got %v, want context.Canceled", err)
+	}
+	select {
+	case <-ctx.Done():
+		t.Fatal("call canceled while a waiter is still alive")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Last waiter leaves, the call must be canceled
+	cancel2()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Errorf("second waiter got %v, want context.Canceled", err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("call not canceled after the last waiter left")
+	}
+}
+
+func waitWaiters(t *testing.T, g *FlightGroup, key string, n int) {
+	t.Helper()
+	for range 100 {
+		g.mu.Lock()
+		c, ok := g.m[key]
+		done := ok && c.waiters == n
+		g.mu.Unlock()
+		if done {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d waiters", n)
+}
+
+func TestFlightGroupPanic(t *testing.T) {
+	var g FlightGroup
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		<-release
+		panic("boom")
+	}
+
+	// Every waiter panics in its own goroutine, where it can be recovered
+	recovered := make(chan interface{}, 2)
+	for range 2 {
+		go func() {
+			defer func() { recovered <- recover() }()
+			g.Do(context.Background(), "key", fn)
+		}()
+	}
+	waitWaiters(t, &g, "key", 2)
+	close(release)
+
+	for range 2 {
+		var p *PanicError
+		r := <-recovered
+		if err, ok := r.(error); !ok || !errors.As(err, &p) || p.Value != "boom" {
+			t.Errorf("got panic %v, want PanicError boom", r)
+		}
+	}
+
+	// The key is free for the next call
+	v, err, _ := g.Do(context.Background(), "key", func(ctx context.Context) (interface{}, error) { return "ok", nil })
+	if v != "ok" || err != nil {
+		t.Errorf("got %v, %v after panic, want ok", v, err)
+	}
+}
@@ -1,6 +1,9 @@
 package utils
 
-import "unicode/utf8"
+import (
+	"strconv"
+	"unicode/utf8"
+)
 
 // Substr returns a substring of a given string, starting at the specified index
 // and with a specified length.
@@ -49,3 +52,27 @@ func Substr(str string, start int, length ...int) string {
 	// Return the substring.
 	return string(runes[start:end])
 }
+
+// FormatCount formats a count the way Instagram does, e.g. 1234 -> 1.2K
+func FormatCount(n int64) string {
+	switch {
+	case n < 1_000:
+		return strconv.FormatInt(n, 10)
+	case n < 1_000_000:
+		return formatUnit(n, 1_000) + "K"
+	case n < 1_000_000_000:
+		return formatUnit(n, 1_000_000) + "M"
+	default:
+		return formatUnit(n, 1_000_000_000) + "B"
+	}
+}
+
+// formatUnit divides n by unit with at most one decimal, truncated
+func formatUnit(n, unit int64) string {
+	whole := n / unit
+	decimal := n % unit * 10 / unit
+	if whole >= 100 || decimal == 0 {
+		return strconv.FormatInt(whole, 10)
+	}
+	return strconv.FormatInt(whole, 10) + "." + strconv.FormatInt(decimal, 10)
+}
@@ -30,6 +30,8 @@ const (
 	embed__23 = `"/><meta property="og:video:height" content="`
 	embed__25 = `<link rel="alternate" href="`
 	embed__26 = `" type="application/json+oembed" title="`
+	embed__27 = `<meta property="article:published_time" content="`
+	embed__28 = `" type="text/xml+oembed" title="`
 )
 
 func Embed(v *model.ViewsData, wr io.Writer) {
@@ -75,6 +77,11 @@ func Embed(v *model.ViewsData, wr io.Writer) {
 		WriteEscString(v.ImageURL, buffer)
 		buffer.WriteString(embed__3)
 	}
+	if v.PublishedTime != "" {
+		buffer.WriteString(embed__27)
+		WriteEscString(v.PublishedTime, buffer)
+		buffer.WriteString(embed__3)
+	}
 	if v.VideoURL != "" {
 		buffer.WriteString(embed__20)
 		WriteEscString(v.VideoURL, buffer)
@@ -92,6 +99,11 @@ func Embed(v *model.ViewsData, wr io.Writer) {
 		buffer.WriteString(embed__26)
 		WriteEscString(v.Title, buffer)
 		buffer.WriteString(embed__3)
+		buffer.WriteString(embed__25)
+		buffer.WriteString(v.OEmbedURL + "&format=xml")
+		buffer.WriteString(embed__28)
+		WriteEscString(v.Title, buffer)
+		buffer.WriteString(embed__3)
 	}
 	buffer.WriteString(embed__4)
 	WriteEscString(`0; url = `+v.URL+``, buffer)
@@ -1,5 +1,7 @@
 package model
 
+import "encoding/xml"
+
 type ViewsData struct {
 	Card        string
 	Title       string `default:"InstaFix"`
@@ -8,11 +10,28 @@ type ViewsData struct {
 	URL         string
 	Description string
 	OEmbedURL   string
-	Width       int `default:"400"`
-	Height      int `default:"400"`
+	// RFC 3339 timestamp of when the post was taken
+	PublishedTime string
+	Width         int
+	Height        int
 }
 
+// OEmbedData is an oEmbed response, see https://oembed.com/#section2.3
 type OEmbedData struct {
-	Text string
-	URL  string
+	XMLName         xml.Name `json:"-" xml:"oembed"`
+	Version         string   `json:"version" xml:"version"`
+	Type            string   `json:"type" xml:"type"`
+	Title           string   `json:"title,omitempty" xml:"title,omitempty"`
+	AuthorName      string   `json:"author_name,omitempty" xml:"author_name,omitempty"`
+	AuthorURL       string   `json:"author_url,omitempty" xml:"author_url,omitempty"`
+	ProviderName    string   `json:"provider_name" xml:"provider_name"`
+	ProviderURL     string   `json:"provider_url" xml:"provider_url"`
+	CacheAge        int      `json:"cache_age,omitempty" xml:"cache_age,omitempty"`
+	ThumbnailURL    string   `json:"thumbnail_url,omitempty" xml:"thumbnail_url,omitempty"`
+	ThumbnailWidth  int      `json:"thumbnail_width,omitempty" xml:"thumbnail_width,omitempty"`
+	ThumbnailHeight int      `json:"thumbnail_height,omitempty" xml:"thumbnail_height,omitempty"`
+	URL             string   `json:"url,omitempty" xml:"url,omitempty"`
+	HTML            string   `json:"html,omitempty" xml:"html,omitempty"`
+	Width           int      `json:"width,omitempty" xml:"width,omitempty"`
+	Height          int      `json:"height,omitempty" xml:"height,omitempty"`
 }